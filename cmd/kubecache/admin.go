@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	adminPurgePath          = "/cache/purge"
+	adminStatsPath          = "/cache/stats"
+	adminPeersPath          = "/cache/peers"
+	adminNamespacesPath     = "/cache/namespaces"
+	adminNamespacePurgePath = "/cache/namespaces/purge"
+	adminSpringMonitorPath  = "/monitor"
+)
+
+// purgeResult is the admin api response for a purge request.
+type purgeResult struct {
+	Key    string   `json:"key"`
+	Peers  []string `json:"peers,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// adminHandler serves the admin api. When ADMIN_TOKEN is set, every request,
+// including those from peers, must carry it as a bearer token.
+func (app *application) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+adminPurgePath, app.handlePurge)
+	mux.HandleFunc("GET "+adminStatsPath, app.handleStats)
+	mux.HandleFunc("GET "+adminPeersPath, app.handlePeers)
+	mux.HandleFunc("GET "+adminNamespacesPath, app.handleNamespaces)
+	mux.HandleFunc("POST "+adminNamespacePurgePath, app.handleNamespacePurge)
+	if app.cfg.springMonitorEnable {
+		mux.HandleFunc("POST "+adminSpringMonitorPath, app.handleSpringMonitor)
+	}
+	if app.cfg.adminToken == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == adminSpringMonitorPath && app.cfg.springMonitorSecret != "" {
+			mux.ServeHTTP(w, r) // handleSpringMonitor also accepts the webhook secret
+			return
+		}
+		if !validToken(r, app.cfg.adminToken) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// validToken checks the bearer token in the Authorization header.
+func validToken(r *http.Request, token string) bool {
+	got, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// handlePurge removes a key from the cluster.
+//
+// The key is built from query parameters method (default GET), uri and
+// header (repeatable, Name:value) exactly as ServeHTTP would build it.
+//
+// groupcache Remove drops the key from the owner and from every hot cache.
+// Since each peer also retains the entries it owns in the stale store, the
+// key is first removed from the stale store of every peer, by calling this
+// same endpoint on peers with local=true.
+func (app *application) handlePurge(w http.ResponseWriter, r *http.Request) {
+
+	const me = "app.handlePurge"
+	ctx, span := app.tracer.Start(r.Context(), me)
+	defer span.End()
+
+	q := r.URL.Query()
+	local := q.Get("local") == "true"
+
+	key := q.Get("key") // sent by peers
+	if key == "" {
+		var errKey error
+		key, errKey = app.purgeKey(q)
+		if errKey != nil {
+			http.Error(w, errKey.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result := purgeResult{Key: redactKey(key)}
+
+	app.stale.purge(key)
+
+	if !local {
+		peerQuery := url.Values{}
+		peerQuery.Set("key", key)
+		peerQuery.Set("local", "true")
+		result.Peers, result.Errors = app.fanOut(ctx, adminPurgePath, peerQuery)
+
+		if errRemove := app.cache.Remove(ctx, key); errRemove != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("remove: %v", errRemove))
+		}
+	}
+
+	status := http.StatusOK
+	if len(result.Errors) > 0 {
+		status = http.StatusInternalServerError
+		log.Error().Msgf("%s: key='%s' errors: %v", me, redactKey(key), result.Errors)
+	} else {
+		log.Info().Msgf("%s: key='%s' local=%t peers=%v", me, redactKey(key), local, result.Peers)
+	}
+
+	writeJSON(me, w, status, result)
+}
+
+// handleStats reports this node cache statistics.
+func (app *application) handleStats(w http.ResponseWriter, _ *http.Request) {
+	const me = "app.handleStats"
+	writeJSON(me, w, http.StatusOK, app.cache.Stats())
+}
+
+// peersResult is the admin api response for the peers request.
+type peersResult struct {
+	Self    string    `json:"self"`
+	Compute string    `json:"compute"`
+	Peers   []string  `json:"peers"`
+	Changed time.Time `json:"changed"`
+	Key     string    `json:"key,omitempty"`
+	Owner   string    `json:"owner,omitempty"`
+}
+
+// handlePeers reports the peers as delivered to groupcache by discovery.
+// When the query carries a key (key or uri, method and header as in purge),
+// it also reports the peer owning the key under the consistent hash.
+func (app *application) handlePeers(w http.ResponseWriter, r *http.Request) {
+	const me = "app.handlePeers"
+
+	peers, changed := app.peers.list()
+
+	result := peersResult{
+		Self:    app.peers.self,
+		Compute: app.cfg.compute,
+		Peers:   peers,
+		Changed: changed,
+	}
+
+	q := r.URL.Query()
+	key := q.Get("key")
+	if key == "" && q.Get("uri") != "" {
+		var errKey error
+		key, errKey = app.purgeKey(q)
+		if errKey != nil {
+			http.Error(w, errKey.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if key != "" {
+		result.Key = redactKey(key)
+		result.Owner = app.peers.keyOwner(key)
+	}
+
+	writeJSON(me, w, http.StatusOK, result)
+}
+
+// namespacePurgeResult is the admin api response for a namespace purge request.
+type namespacePurgeResult struct {
+	Namespace  string   `json:"namespace"`
+	Generation uint64   `json:"generation"`
+	Peers      []string `json:"peers,omitempty"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// handleNamespaces reports the namespace generations. Peers pull them
+// periodically in order to catch up with missed purges.
+func (app *application) handleNamespaces(w http.ResponseWriter, _ *http.Request) {
+	const me = "app.handleNamespaces"
+	writeJSON(me, w, http.StatusOK, app.namespaces.snapshot())
+}
+
+// handleNamespacePurge purges every entry of the namespace across the cluster,
+// by bumping the namespace generation and propagating it to peers.
+// Peers receive the new generation with local=true.
+func (app *application) handleNamespacePurge(w http.ResponseWriter, r *http.Request) {
+
+	const me = "app.handleNamespacePurge"
+	ctx, span := app.tracer.Start(r.Context(), me)
+	defer span.End()
+
+	q := r.URL.Query()
+	name := q.Get("namespace")
+
+	if q.Get("local") == "true" {
+		//
+		// namespaces derived from requests (like spring applications) are
+		// not configured, hence peers accept them by name format
+		//
+		if !app.validNamespace(name) {
+			http.Error(w, fmt.Sprintf("invalid namespace: '%s'", name), http.StatusBadRequest)
+			return
+		}
+		gen, errGen := strconv.ParseUint(q.Get("generation"), 10, 64)
+		if errGen != nil {
+			http.Error(w, fmt.Sprintf("bad generation: %v", errGen), http.StatusBadRequest)
+			return
+		}
+		app.namespaces.merge(map[string]uint64{name: gen})
+		log.Info().Msgf("%s: namespace='%s' generation=%d local=true", me, name, gen)
+		writeJSON(me, w, http.StatusOK, namespacePurgeResult{Namespace: name, Generation: gen})
+		return
+	}
+
+	if !app.namespaces.exists(name) {
+		http.Error(w, fmt.Sprintf("unknown namespace: '%s'", name), http.StatusNotFound)
+		return
+	}
+
+	result := app.bumpNamespace(ctx, name)
+
+	status := http.StatusOK
+	if len(result.Errors) > 0 {
+		status = http.StatusInternalServerError
+		log.Error().Msgf("%s: namespace='%s' generation=%d errors: %v",
+			me, name, result.Generation, result.Errors)
+	} else {
+		log.Info().Msgf("%s: namespace='%s' generation=%d peers=%v",
+			me, name, result.Generation, result.Peers)
+	}
+
+	writeJSON(me, w, status, result)
+}
+
+// bumpNamespace bumps the namespace generation and propagates it to peers.
+func (app *application) bumpNamespace(ctx context.Context, name string) namespacePurgeResult {
+	gen, ok := app.namespaces.bump(name)
+	result := namespacePurgeResult{
+		Namespace:  name,
+		Generation: gen,
+	}
+	if !ok {
+		result.Errors = []string{fmt.Sprintf("namespace store full: not tracking namespace='%s'", name)}
+		return result
+	}
+
+	peerQuery := url.Values{}
+	peerQuery.Set("namespace", name)
+	peerQuery.Set("generation", strconv.FormatUint(result.Generation, 10))
+	peerQuery.Set("local", "true")
+	result.Peers, result.Errors = app.fanOut(ctx, adminNamespacePurgePath, peerQuery)
+
+	return result
+}
+
+func writeJSON(caller string, w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Msgf("%s: write response: %v", caller, err)
+	}
+}
+
+// purgeKey builds the cache key from the purge query parameters.
+func (app *application) purgeKey(q url.Values) (string, error) {
+	uri := q.Get("uri")
+	if uri == "" {
+		return "", fmt.Errorf("missing uri parameter")
+	}
+
+	method := strings.ToUpper(q.Get("method"))
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, errReq := http.NewRequest(method, uri, nil)
+	if errReq != nil {
+		return "", fmt.Errorf("bad request: %v", errReq)
+	}
+
+	for _, h := range q["header"] {
+		name, value, found := strings.Cut(h, ":")
+		if !found {
+			return "", fmt.Errorf("bad header parameter, expecting Name:value: '%s'", h)
+		}
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	route := method + " " + req.URL.Path
+
+	return app.requestKey(req, route), nil
+}
+
+// fanOut calls the admin path on every other peer, returning the peers
+// reached and the errors found.
+func (app *application) fanOut(c context.Context, path string, query url.Values) ([]string, []string) {
+
+	const me = "app.fanOut"
+	ctx, span := app.tracer.Start(c, me)
+	defer span.End()
+
+	peerURLs, errURLs := app.peerAdminURLs()
+	if errURLs != nil {
+		return nil, []string{errURLs.Error()}
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		peers []string
+		errs  []string
+	)
+
+	for _, peerURL := range peerURLs {
+		u := peerURL + path + "?" + query.Encode()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := app.adminCall(ctx, http.MethodPost, u)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("peer %s: %v", peerURL, err))
+				return
+			}
+			peers = append(peers, peerURL)
+		}()
+	}
+
+	wg.Wait()
+
+	return peers, errs
+}
+
+// peerAdminURLs returns the admin api base URL of every other peer.
+// Peers listen on the admin port at the same offset from their groupcache
+// port as this pod: on Kubernetes every pod uses the ADMIN_ADDR port, while
+// static peers sharing a host use distinct ports.
+func (app *application) peerAdminURLs() ([]string, error) {
+	_, adminPort, errAdmin := net.SplitHostPort(app.cfg.adminAddr)
+	if errAdmin != nil {
+		return nil, fmt.Errorf("admin addr: '%s': %v", app.cfg.adminAddr, errAdmin)
+	}
+	_, selfPort, errSelf := peerHostPort(app.peers.self)
+	if errSelf != nil {
+		return nil, fmt.Errorf("self: '%s': %v", app.peers.self, errSelf)
+	}
+	offset, errOffset := portOffset(selfPort, adminPort)
+	if errOffset != nil {
+		return nil, errOffset
+	}
+
+	var urls []string
+	for _, p := range app.peers.others() {
+		host, port, errPeer := peerHostPort(p)
+		if errPeer != nil {
+			log.Error().Msgf("peer admin url: peer '%s': %v", p, errPeer)
+			continue
+		}
+		peerPort, errPort := strconv.Atoi(port)
+		if errPort != nil {
+			log.Error().Msgf("peer admin url: peer '%s': port: %v", p, errPort)
+			continue
+		}
+		urls = append(urls, "http://"+net.JoinHostPort(host, strconv.Itoa(peerPort+offset)))
+	}
+	return urls, nil
+}
+
+// portOffset returns the distance from the groupcache port to the admin port.
+func portOffset(groupcachePort, adminPort string) (int, error) {
+	gp, errGp := strconv.Atoi(groupcachePort)
+	if errGp != nil {
+		return 0, fmt.Errorf("groupcache port: '%s': %v", groupcachePort, errGp)
+	}
+	ap, errAp := strconv.Atoi(adminPort)
+	if errAp != nil {
+		return 0, fmt.Errorf("admin port: '%s': %v", adminPort, errAp)
+	}
+	return ap - gp, nil
+}
+
+// adminCall calls the admin api on a peer, returning the response body.
+// The client is bounded by ADMIN_PEER_TIMEOUT.
+func (app *application) adminCall(ctx context.Context, method, u string) ([]byte, error) {
+	req, errReq := http.NewRequestWithContext(ctx, method, u, nil)
+	if errReq != nil {
+		return nil, errReq
+	}
+	if app.cfg.adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+app.cfg.adminToken)
+	}
+	resp, errDo := app.adminClient.Do(req)
+	if errDo != nil {
+		return nil, errDo
+	}
+	defer resp.Body.Close()
+	body, errBody := io.ReadAll(resp.Body)
+	if errBody != nil {
+		return nil, errBody
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
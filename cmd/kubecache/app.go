@@ -2,20 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/groupcache/groupcache-go/v3/transport"
-	"github.com/modernprogram/groupcache/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/rs/zerolog/log"
+	"github.com/udhos/aws-emf/emf"
 	"github.com/udhos/dogstatsdclient/dogstatsdclient"
 	"github.com/udhos/otelconfig/oteltrace"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -28,18 +33,40 @@ type application struct {
 	tracer              trace.Tracer
 	registry            *prometheus.Registry
 	metrics             *prometheusMetrics
+	metricsRoutes       *routeTemplates
 	dogstatsdClient     *dogstatsdclient.Client
+	emf                 *emf.Metric // backend metrics in CloudWatch EMF
+	emfMutex            sync.Mutex
+	emfPending          bool // backend metrics recorded since the last export
+	emfStop             func()
 	serverMain          *http.Server
 	serverHealth        *http.Server
 	serverMetrics       *http.Server
+	serverAdmin         *http.Server
 	serverGroupCache    *http.Server
-	cache               *groupcache.Group
-	cache3              transport.Group
-	groupcacheClose     func()
+	cache               cache
+	peers               *peerTracker
 	restrictRouteRegexp []*regexp.Regexp
+	springRouteRegexp   []*regexp.Regexp
 	restrictMethod      []string
+	cacheKeyHeaders     []string
+	diagnosticHeaders   []string
+	forwardAllow        []string
+	forwardDeny         []string
+	vary                *varyStore
+	stale               *staleStore
+	namespaces          *namespaceStore
+	namespaceSyncStop   func()
+	backendProbeStop    func()
+	ready               readiness
+	refreshing          sync.Map     // keys being refreshed in background
+	fetches             fetchCounter // backend fetches in flight
 	backendURL          *url.URL
 	httpClient          *http.Client
+	adminClient         *http.Client // peer admin api calls
+	reverseProxy        *httputil.ReverseProxy
+	backgroundCtx       context.Context // cancelled by stop, for background refreshes
+	backgroundCancel    context.CancelFunc
 }
 
 func (app *application) run() {
@@ -48,13 +75,84 @@ func (app *application) run() {
 	log.Error().Msgf("application server: exited: %v", err)
 }
 
+// stop drains the application: fail readiness, wait for the load balancers
+// to notice, stop accepting requests, finish in-flight fetches and only then
+// leave the peer ring, so peers can still reach this pod meanwhile.
 func (app *application) stop() {
-	app.groupcacheClose()
+	log.Info().Msgf("drain: failing readiness, waiting %v", app.cfg.shutdownDrainDelay)
+	app.ready.draining.Store(true)
+	time.Sleep(app.cfg.shutdownDrainDelay)
+
+	log.Info().Msgf("drain: stopping application server")
+	httpShutdown(app.serverMain, "main", app.cfg.shutdownServerTimeout)
+
+	log.Info().Msgf("drain: waiting in-flight fetches")
+	app.waitFetches(app.cfg.shutdownFetchTimeout)
+	app.backgroundCancel()
+
+	log.Info().Msgf("drain: leaving peer ring")
+	app.namespaceSyncStop()
+	app.backendProbeStop()
+	app.cache.Close()
+	httpShutdown(app.serverGroupCache, "groupcache", app.cfg.shutdownPeerTimeout)
+	app.emfStop()
+
 	const timeout = 5 * time.Second
-	httpShutdown(app.serverHealth, "health", timeout)
-	httpShutdown(app.serverMain, "main", timeout)
-	httpShutdown(app.serverGroupCache, "groupcache", timeout)
 	httpShutdown(app.serverMetrics, "metrics", timeout)
+	httpShutdown(app.serverAdmin, "admin", timeout)
+	httpShutdown(app.serverHealth, "health", timeout)
+}
+
+// waitFetches waits for the backend fetches in flight, including background
+// refreshes and loads requested by peers, up to the timeout. It reports
+// whether all fetches finished.
+func (app *application) waitFetches(timeout time.Duration) bool {
+	select {
+	case <-app.fetches.idle():
+		return true
+	case <-time.After(timeout):
+		log.Error().Msgf("drain: giving up on in-flight fetches after %v", timeout)
+		return false
+	}
+}
+
+// fetchCounter counts the fetches in flight. Unlike sync.WaitGroup, fetches
+// may start while waiting: the peer server and background refreshes keep
+// fetching during the drain.
+type fetchCounter struct {
+	mu    sync.Mutex
+	count int
+	zero  chan struct{} // closed when count drops to zero
+}
+
+func (c *fetchCounter) begin() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.count == 0 {
+		c.zero = make(chan struct{})
+	}
+	c.count++
+}
+
+func (c *fetchCounter) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count--
+	if c.count == 0 {
+		close(c.zero)
+	}
+}
+
+// idle returns a channel closed once no fetches are in flight.
+func (c *fetchCounter) idle() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.count == 0 {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return c.zero
 }
 
 func newApplication(me string) *application {
@@ -63,6 +161,8 @@ func newApplication(me string) *application {
 		tracer: oteltrace.NewNoopTracer(),
 	}
 
+	app.backgroundCtx, app.backgroundCancel = context.WithCancel(context.Background())
+
 	if app.cfg.prometheusEnable {
 		app.registry = prometheus.NewRegistry()
 	}
@@ -80,12 +180,16 @@ func newApplication(me string) *application {
 		app.dogstatsdClient = client
 	}
 
-	initApplication(app, app.cfg.kubegroupForceNamespaceDefault)
+	initApplication(app)
 
 	return app
 }
 
-func initApplication(app *application, forceNamespaceDefault bool) {
+func initApplication(app *application) {
+
+	if errConfig := app.cfg.validate(); errConfig != nil {
+		log.Fatal().Msgf("config: %v", errConfig)
+	}
 
 	{
 		u, errURL := url.Parse(app.cfg.backendURL)
@@ -110,6 +214,21 @@ func initApplication(app *application, forceNamespaceDefault bool) {
 		}
 	}
 
+	{
+		var regexpList []string
+		errRegexpList := json.Unmarshal([]byte(app.cfg.springRouteRegexp), &regexpList)
+		if errRegexpList != nil {
+			log.Fatal().Msgf("spring route regexp: '%s': %v", app.cfg.springRouteRegexp, errRegexpList)
+		}
+		for _, expr := range regexpList {
+			re, errRe := regexp.Compile(expr)
+			if errRe != nil {
+				log.Fatal().Msgf("spring route regexp: compile: expr='%s': %v", expr, errRe)
+			}
+			app.springRouteRegexp = append(app.springRouteRegexp, re)
+		}
+	}
+
 	{
 		errList := json.Unmarshal([]byte(app.cfg.restrictMethod), &app.restrictMethod)
 		if errList != nil {
@@ -120,11 +239,59 @@ func initApplication(app *application, forceNamespaceDefault bool) {
 		}
 	}
 
+	switch app.cfg.cacheEncoding {
+	case "json", "binary":
+	default:
+		log.Fatal().Msgf("cache encoding: '%s': expected json or binary", app.cfg.cacheEncoding)
+	}
+
+	if app.cfg.springMonitorEnable && !app.cfg.adminEnable {
+		log.Fatal().Msgf("spring monitor: SPRING_MONITOR_ENABLE requires ADMIN_ENABLE, since /monitor is served by the admin api")
+	}
+
+	app.cacheKeyHeaders = parseHeaderList("cache key headers", app.cfg.cacheKeyHeaders)
+	app.diagnosticHeaders = parseHeaderList("cache diagnostic headers", app.cfg.cacheDiagnosticHeaders)
+	app.forwardAllow = parseHeaderList("forward headers", app.cfg.forwardHeaders)
+	if slices.Contains(app.forwardAllow, "*") {
+		log.Fatal().Msgf("forward headers: '%s': wildcard not supported, name headers explicitly",
+			app.cfg.forwardHeaders)
+	}
+	app.forwardDeny = parseHeaderList("forward headers deny", app.cfg.forwardHeadersDeny)
+
+	app.vary = newVaryStore(app.cfg.cacheVaryMaxRoutes)
+
+	app.stale = newStaleStore(max(app.cfg.cacheStaleRetention,
+		app.cfg.cacheStaleWhileRevalidate, app.cfg.cacheStaleIfError),
+		app.cfg.cacheStaleSizeBytes)
+
+	{
+		ns, errNs := newNamespaceStore(app.cfg.cacheNamespaces, app.cfg.springMaxApplications+1)
+		if errNs != nil {
+			log.Fatal().Msgf("%v", errNs)
+		}
+		app.namespaces = ns
+	}
+
 	app.httpClient = &http.Client{
 		Transport: otelhttp.NewTransport(http.DefaultTransport),
 		Timeout:   app.cfg.backendTimeout,
 	}
 
+	app.adminClient = &http.Client{Timeout: app.cfg.adminPeerTimeout}
+
+	app.reverseProxy = app.newProxy()
+
+	app.emfStop = app.startBackendEMF()
+
+	{
+		routes, errRoutes := newRouteTemplates(app.cfg.metricsRouteTemplates,
+			app.cfg.metricsRouteSpring, app.cfg.metricsRouteOverflow)
+		if errRoutes != nil {
+			log.Fatal().Msgf("%v", errRoutes)
+		}
+		app.metricsRoutes = routes
+	}
+
 	if app.cfg.prometheusEnable {
 		//
 		// add basic/default Prometheus instrumentation
@@ -137,14 +304,19 @@ func initApplication(app *application, forceNamespaceDefault bool) {
 	}
 
 	//
-	// start group cache
+	// start cache
 	//
-	if app.cfg.groupcacheVersion == 3 {
-		app.groupcacheClose = startGroupcache3(app, forceNamespaceDefault)
+	app.cache = newCache(app)
+
+	app.namespaceSyncStop = func() {}
+	if (app.namespaces.enabled() || app.cfg.springMonitorEnable) && app.cfg.adminEnable {
+		app.namespaceSyncStop = app.startNamespaceSync()
 	} else {
-		app.groupcacheClose = startGroupcache(app, forceNamespaceDefault)
+		app.ready.namespacesSynced.Store(true)
 	}
 
+	app.backendProbeStop = app.startBackendProbe()
+
 	//
 	// register application route
 	//
@@ -159,6 +331,19 @@ func initApplication(app *application, forceNamespaceDefault bool) {
 	mux.Handle(route, otelhttp.NewHandler(app, "app.ServerHTTP"))
 }
 
+// parseHeaderList parses a JSON list of header names into canonical form.
+func parseHeaderList(label, list string) []string {
+	var headers []string
+	errList := json.Unmarshal([]byte(list), &headers)
+	if errList != nil {
+		log.Fatal().Msgf("%s: '%s': %v", label, list, errList)
+	}
+	for i, h := range headers {
+		headers[i] = http.CanonicalHeaderKey(h)
+	}
+	return headers
+}
+
 func httpShutdown(s *http.Server, label string, timeout time.Duration) {
 	if s == nil {
 		return
@@ -227,6 +412,7 @@ var traceResponseError = attribute.Key("response_error")
 var traceElapsed = attribute.Key("elapsed")
 var traceUseCache = attribute.Key("use_cache")
 var traceReqIP = attribute.Key("request_ip")
+var traceCacheResult = attribute.Key("cache_result")
 
 func (app *application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
@@ -240,22 +426,69 @@ func (app *application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	method := r.Method
 
-	key := method + " " + uri
+	route := method + " " + r.URL.Path
 
 	useCache := mustCache(method, r.URL.RequestURI(), app.restrictMethod, app.restrictRouteRegexp)
 
 	reqIP, _, _ := strings.Cut(r.RemoteAddr, ":")
 
-	resp, errFetch := app.query(ctx, key, reqIP, useCache)
+	var resp response
+	var errFetch error
+	var key string
+	cacheResult := cacheResultBypass
+
+	if useCache {
+		var rec *cacheResultRecorder
+		ctx, rec = withCacheResult(ctx)
+		ctx = withForwarded(ctx, r)
+
+		key = app.requestKey(r, route)
+
+		resp, errFetch = app.query(ctx, key, reqIP)
+
+		if errFetch == nil && app.vary.learn(route, resp.Header) {
+			//
+			// backend response varies on headers missing from the key:
+			// query again with a key including them
+			//
+			key = app.requestKey(r, route)
+			resp, errFetch = app.query(ctx, key, reqIP)
+		}
+
+		cacheResult = rec.result(errFetch, app.peers.owns(key))
+
+		if errFetch == nil && notModified(r, resp) {
+			//
+			// client already holds the cached response
+			//
+			resp = notModifiedResponse(resp)
+		}
+	} else {
+		//
+		// not cacheable: the proxy streams the response to the client
+		//
+		resp, errFetch = app.proxy(ctx, w, r) // sets the diagnostic headers
+	}
 
 	isFetchError := errFetch != nil
 
 	elap := time.Since(begin)
 
+	metricsRoute := app.metricsRoutes.route(r.URL.Path)
+
 	if app.cfg.prometheusEnable {
 		outcome := outcomeFrom(resp.Status, isFetchError)
 
-		app.metrics.recordLatency(r.Method, strconv.Itoa(resp.Status), uri, outcome, elap)
+		app.metrics.recordLatency(r.Method, strconv.Itoa(resp.Status),
+			metricsRoute, outcome, elap)
+		app.metrics.recordCacheResult(r.Method, metricsRoute, cacheResult)
+	}
+
+	if app.dogstatsdClient != nil {
+		tags := []string{"method:" + r.Method, "uri:" + metricsRoute, "result:" + cacheResult}
+		if errDd := app.dogstatsdClient.Incr("cache_results", tags, 1); errDd != nil {
+			log.Error().Msgf("dogstatsd cache_results: %v", errDd)
+		}
 	}
 
 	//
@@ -289,11 +522,16 @@ func (app *application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		traceElapsed.String(elap.String()),
 		traceUseCache.Bool(useCache),
 		traceReqIP.String(reqIP),
+		traceCacheResult.String(cacheResult),
 	)
 	if isFetchError {
 		span.SetAttributes(traceResponseError.String(errFetch.Error()))
 	}
 
+	if !useCache {
+		return // response already sent by the proxy
+	}
+
 	//
 	// send response headers (1/3)
 	//
@@ -302,6 +540,7 @@ func (app *application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add(k, vv)
 		}
 	}
+	app.setDiagnosticHeaders(w.Header(), cacheResult, key, resp)
 
 	//
 	// send response status (2/3)
@@ -336,62 +575,108 @@ func isHTTPError(status int) bool {
 	return status < 200 || status > 299
 }
 
-func (app *application) query(c context.Context, key, _ /*reqIP*/ string, useCache bool) (response, error) {
+func (app *application) query(c context.Context, key, _ /*reqIP*/ string) (response, error) {
 
 	const me = "app.query"
 	ctx, span := app.tracer.Start(c, me)
 	defer span.End()
 
-	if useCache {
-		var resp response
-		var data []byte
+	var resp response
 
-		if app.cfg.groupcacheVersion == 3 {
-			//
-			// groupcache 3
-			//
-			if errGet := app.cache3.Get(ctx, key, transport.AllocatingByteSliceSink(&data)); errGet != nil {
-				log.Error().Msgf("key='%s' cache error:%v", key, errGet)
-				resp.Status = 500
-				return resp, errGet
+	data, errGet := app.cache.Get(ctx, key)
+	if errGet != nil {
+		if notStoredResp, available, found := notStored(errGet); found {
+			if available {
+				return notStoredResp, nil
 			}
-		} else {
 			//
-			// groupcache 2
+			// the key owner refused to store a response too large to
+			// carry back: fetch it directly
 			//
-			if errGet := app.cache.Get(ctx, key, groupcache.AllocatingByteSliceSink(&data), nil); errGet != nil {
-				log.Error().Msgf("key='%s' cache error:%v", key, errGet)
-				resp.Status = 500
-				return resp, errGet
-			}
-		}
-
-		if errJ := json.Unmarshal(data, &resp); errJ != nil {
-			log.Error().Msgf("key='%s' json error:%v", key, errJ)
-			resp.Status = 500
-			return resp, errJ
+			return app.fetchUncached(ctx, key)
 		}
+		log.Error().Msgf("key='%s' cache error:%v", redactKey(key), errGet)
+		resp.Status = 500
+		return resp, errGet
+	}
 
-		return resp, nil
+	resp, errDecode := decodeResponse(data)
+	if errDecode != nil {
+		log.Error().Msgf("key='%s' decode error:%v", redactKey(key), errDecode)
+		resp.Status = 500
+		return resp, errDecode
 	}
 
-	resp, _, errFetch := doFetch(ctx, app.tracer, app.httpClient, app.backendURL, key)
-	if errFetch != nil {
+	return resp, nil
+}
+
+// fetchUncached fetches a response that must not be stored, bypassing the cache.
+func (app *application) fetchUncached(ctx context.Context, key string) (response, error) {
+	resp, _, errFetch := app.fetchEntry(ctx, key, staleEntry{}, false)
+	if errFetch != nil && !isNotStored(errFetch) {
+		resp.Status = 500
 		return resp, errFetch
 	}
-
 	return resp, nil
 }
 
-func parseKey(caller string, backendURL *url.URL, key string) (string, string, error) {
-	method, uri, found := strings.Cut(key, " ")
+// buildKey builds the groupcache key as "METHOD URI", followed by one
+// "\nName: value" line for every request header that is part of the key.
+// Header lines are sorted by name, so the key does not depend on map order.
+func buildKey(method, uri string, header http.Header) string {
+	var sb strings.Builder
+	sb.WriteString(method)
+	sb.WriteString(" ")
+	sb.WriteString(uri)
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		for _, v := range header[name] {
+			sb.WriteString("\n")
+			sb.WriteString(name)
+			sb.WriteString(": ")
+			sb.WriteString(v)
+		}
+	}
+	return sb.String()
+}
+
+// redactKey renders the key for logs and admin responses: the key header
+// values may carry credentials, like Authorization or cookies, so the header
+// lines are replaced by a digest that still tells keys apart.
+func redactKey(key string) string {
+	first, headerLines, found := strings.Cut(key, "\n")
 	if !found {
-		return "", "", fmt.Errorf("%s: parseKey: bad key: '%s'", caller, key)
+		return first
+	}
+	sum := sha256.Sum256([]byte(headerLines))
+	return first + " headers=sha256:" + hex.EncodeToString(sum[:8])
+}
+
+func parseKey(caller string, backendURL *url.URL, key string) (string, string, http.Header, error) {
+	first, headerLines, _ := strings.Cut(key, "\n")
+
+	if generations, rest, found := strings.Cut(first, " "); found && strings.Contains(generations, "@") {
+		first = rest // skip namespace generations: '@' is not valid in a method
+	}
+
+	method, uri, found := strings.Cut(first, " ")
+	if !found {
+		return "", "", nil, fmt.Errorf("%s: parseKey: bad key: '%s'", caller, redactKey(key))
+	}
+
+	header := http.Header{}
+	if headerLines != "" {
+		for _, line := range strings.Split(headerLines, "\n") {
+			name, value, foundHeader := strings.Cut(line, ":")
+			if !foundHeader {
+				return "", "", nil, fmt.Errorf("%s: parseKey: bad header: key='%s'", caller, redactKey(key))
+			}
+			header.Add(name, strings.TrimSpace(value))
+		}
 	}
 
 	reqURL, errParseURL := url.Parse(uri)
 	if errParseURL != nil {
-		return "", "", fmt.Errorf("%s: parse URL: '%s': %v", caller, uri, errParseURL)
+		return "", "", nil, fmt.Errorf("%s: parse URL: '%s': %v", caller, uri, errParseURL)
 	}
 
 	reqURL.Scheme = backendURL.Scheme
@@ -399,11 +684,15 @@ func parseKey(caller string, backendURL *url.URL, key string) (string, string, e
 
 	u := reqURL.String()
 
-	return method, u, nil
+	return method, u, header, nil
 }
 
 type response struct {
-	Body   []byte      `json:"body"`
-	Status int         `json:"status"`
-	Header http.Header `json:"header"`
+	Body          []byte      `json:"body"`
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header"`
+	Stale         bool        `json:"stale,omitempty"`
+	Fetched       time.Time   `json:"fetched,omitzero"`         // backend response time
+	Expire        time.Time   `json:"expire,omitzero"`          // cache expiration
+	GeneratedETag bool        `json:"generated_etag,omitempty"` // Etag generated by kubecache
 }
@@ -1,14 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type bodyTestCase struct {
@@ -172,6 +187,7 @@ func query(name, expected, u string) (time.Duration, error) {
 func envCacheAnything() {
 	os.Setenv("RESTRICT_ROUTE_REGEXP", "[]")
 	os.Setenv("RESTRICT_METHOD", "[]")
+	os.Setenv("SHUTDOWN_DRAIN_DELAY", "0s") // tests stop the application often
 
 	//os.Setenv("RATELIMIT_INTERVAL", "10s")
 	//os.Setenv("RATELIMIT_SLOTS", "1000")
@@ -287,3 +303,1464 @@ func test2(t *testing.T, name, full string) {
 		return
 	}
 }
+
+func TestKey(t *testing.T) {
+	backendURL, _ := url.Parse("http://backend:9000")
+
+	header := http.Header{
+		"Accept-Language": {"pt-BR"},
+		"Accept":          {"application/json"},
+		"Authorization":   {""},
+	}
+
+	key := buildKey("GET", "/prod/app?a=b", header)
+
+	expectedKey := "GET /prod/app?a=b\nAccept: application/json\nAccept-Language: pt-BR\nAuthorization: "
+	if key != expectedKey {
+		t.Errorf("key: expected=%q got=%q", expectedKey, key)
+	}
+
+	method, u, h, errKey := parseKey("TestKey", backendURL, key)
+	if errKey != nil {
+		t.Fatalf("parse key: %v", errKey)
+	}
+	if method != "GET" {
+		t.Errorf("method: expected=GET got=%s", method)
+	}
+	if u != "http://backend:9000/prod/app?a=b" {
+		t.Errorf("url: expected=http://backend:9000/prod/app?a=b got=%s", u)
+	}
+	for name, v := range header {
+		if h.Get(name) != v[0] {
+			t.Errorf("header %s: expected=%q got=%q", name, v[0], h.Get(name))
+		}
+	}
+
+	methodNs, uNs, _, errNs := parseKey("TestKey", backendURL, "prod@2,myapp@1 "+key)
+	if errNs != nil {
+		t.Fatalf("parse key with namespaces: %v", errNs)
+	}
+	if methodNs != method || uNs != u {
+		t.Errorf("key with namespaces: expected=%s %s got=%s %s", method, u, methodNs, uNs)
+	}
+}
+
+func TestRedactKey(t *testing.T) {
+	if r := redactKey("GET /prod/app"); r != "GET /prod/app" {
+		t.Errorf("key without headers: expected unchanged, got %q", r)
+	}
+
+	key := buildKey("GET", "/prod/app", http.Header{"Authorization": []string{"Bearer secret"}})
+	r := redactKey(key)
+	if strings.Contains(r, "secret") || !strings.HasPrefix(r, "GET /prod/app headers=sha256:") {
+		t.Errorf("key with headers: unexpected redaction %q", r)
+	}
+
+	other := buildKey("GET", "/prod/app", http.Header{"Authorization": []string{"Bearer other"}})
+	if redactKey(other) == r {
+		t.Errorf("redacted keys with distinct headers should differ")
+	}
+}
+
+func TestVary(t *testing.T) {
+	var serverHits int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverHits++
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, "lang="+r.Header.Get("Accept-Language"))
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	get := func(lang string) string {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/vary", nil)
+		req.Header.Set("Accept-Language", lang)
+		resp, errGet := http.DefaultClient.Do(req)
+		if errGet != nil {
+			t.Fatalf("get: %v", errGet)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	for _, lang := range []string{"en", "pt", "en", "pt"} {
+		if body := get(lang); body != "lang="+lang {
+			t.Errorf("lang=%s: unexpected body: %s", lang, body)
+		}
+	}
+
+	// 1st fetch learns Vary and is not stored; en and pt are fetched once each
+	if serverHits != 3 {
+		t.Errorf("server hits: expected=3 got=%d", serverHits)
+	}
+}
+
+func TestForwardHeaders(t *testing.T) {
+	var serverHits int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverHits++
+		fmt.Fprintf(w, "tenant=%s secret=%s other=%s xff=%t xfh=%s",
+			r.Header.Get("X-Tenant"), r.Header.Get("X-Secret"), r.Header.Get("X-Other"),
+			r.Header.Get("X-Forwarded-For") != "", r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	t.Setenv("RESTRICT_ROUTE_REGEXP", `["^/cached"]`)
+	t.Setenv("RESTRICT_METHOD", "[]")
+	t.Setenv("CACHE_KEY_HEADERS", `["X-Secret"]`)
+	t.Setenv("FORWARD_HEADERS", `["X-Tenant"]`)
+	t.Setenv("FORWARD_HEADERS_DENY", `["x-secret"]`)
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	get := func(path, tenant, secret string) string {
+		req, _ := http.NewRequest("GET", "http://localhost:8080"+path, nil)
+		req.Header.Set("X-Tenant", tenant)
+		req.Header.Set("X-Secret", secret)
+		req.Header.Set("X-Other", tenant)
+		resp, errGet := http.DefaultClient.Do(req)
+		if errGet != nil {
+			t.Fatalf("get: %v", errGet)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// X-Other is forwarded only on the uncached path
+	testTable := []struct {
+		path     string
+		tenant   string
+		secret   string
+		expected string
+	}{
+		{"/cached", "a", "1", "tenant=a secret= other= xff=true xfh=localhost:8080"},
+		{"/cached", "a", "2", "tenant=a secret= other= xff=true xfh=localhost:8080"},
+		{"/cached", "b", "1", "tenant=b secret= other= xff=true xfh=localhost:8080"},
+		{"/uncached", "c", "1", "tenant=c secret= other=c xff=true xfh=localhost:8080"},
+	}
+
+	for _, data := range testTable {
+		if body := get(data.path, data.tenant, data.secret); body != data.expected {
+			t.Errorf("%s tenant=%s: expected=%q got=%q", data.path, data.tenant, data.expected, body)
+		}
+	}
+
+	// denied X-Secret is not part of the key: tenant a is fetched once
+	if serverHits != 3 {
+		t.Errorf("server hits: expected=3 got=%d", serverHits)
+	}
+}
+
+func TestProxyBody(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(201)
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL, r.Header.Get("Content-Type"), body)
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	t.Setenv("RESTRICT_ROUTE_REGEXP", "[]")
+	t.Setenv("RESTRICT_METHOD", `["GET"]`)
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	resp, errPost := http.Post("http://localhost:8080/api/items?a=b", "application/json",
+		strings.NewReader(`{"name":"item"}`))
+	if errPost != nil {
+		t.Fatalf("post: %v", errPost)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		t.Errorf("status: expected=201 got=%d", resp.StatusCode)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	expected := `POST /api/items?a=b application/json {"name":"item"}`
+	if string(body) != expected {
+		t.Errorf("body: expected=%q got=%q", expected, string(body))
+	}
+
+	size := app.metrics.backendSize.WithLabelValues("POST", "201", "UNKNOWN", app.backendURL.Host).(prometheus.Histogram)
+	if n := testutil.CollectAndCount(size); n != 1 {
+		t.Errorf("expected backend size series for proxied request, got %d", n)
+	}
+}
+
+func TestProxyForwardedFor(t *testing.T) {
+	var xff atomic.Value
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		xff.Store(r.Header.Get("X-Forwarded-For"))
+		respond(t, w, 200, "forwarded")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	t.Setenv("RESTRICT_ROUTE_REGEXP", "[]")
+	t.Setenv("RESTRICT_METHOD", `["GET"]`)
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	req, _ := http.NewRequest("POST", "http://127.0.0.1:8080/api/items", strings.NewReader("x"))
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	resp, errPost := http.DefaultClient.Do(req)
+	if errPost != nil {
+		t.Fatalf("post: %v", errPost)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	expected := "203.0.113.7, 127.0.0.1"
+	if got, _ := xff.Load().(string); got != expected {
+		t.Errorf("X-Forwarded-For: expected=%q got=%q", expected, got)
+	}
+}
+
+func TestProxyError(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	backendURL := s.URL
+	s.Close() // refuse connections
+
+	os.Setenv("BACKEND_URL", backendURL)
+	t.Setenv("RESTRICT_ROUTE_REGEXP", "[]")
+	t.Setenv("RESTRICT_METHOD", `["GET"]`)
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	resp, errPost := http.Post("http://localhost:8080/api/items", "text/plain", strings.NewReader("x"))
+	if errPost != nil {
+		t.Fatalf("post: %v", errPost)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 502 {
+		t.Errorf("status: expected=502 got=%d", resp.StatusCode)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(body), strings.TrimPrefix(backendURL, "http://")) {
+		t.Errorf("body discloses backend address: %q", string(body))
+	}
+
+	errs := app.metrics.backendErrors.WithLabelValues("POST", "UNKNOWN", app.backendURL.Host, "connection_refused")
+	if n := testutil.ToFloat64(errs); n != 1 {
+		t.Errorf("expected 1 connection_refused proxy error, got %v", n)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		w.Header().Set("Last-Modified", lastModified)
+		fmt.Fprint(w, "config")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	get := func(header http.Header) (int, string, http.Header) {
+		req, _ := http.NewRequest("GET", "http://localhost:8080/conditional", nil)
+		req.Header = header
+		resp, errGet := http.DefaultClient.Do(req)
+		if errGet != nil {
+			t.Fatalf("get: %v", errGet)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), resp.Header
+	}
+
+	status, body, h := get(http.Header{})
+	etag := h.Get("Etag")
+	if status != 200 || body != "config" || etag == "" {
+		t.Fatalf("first request: status=%d body=%q etag=%q", status, body, etag)
+	}
+
+	testTable := []struct {
+		name           string
+		header         http.Header
+		expectedStatus int
+	}{
+		{"etag match", http.Header{"If-None-Match": {`"other", ` + etag}}, 304},
+		{"weak etag match", http.Header{"If-None-Match": {"W/" + etag}}, 304},
+		{"etag mismatch", http.Header{"If-None-Match": {`"other"`}}, 200},
+		{"star", http.Header{"If-None-Match": {"*"}}, 304},
+		{"not modified since", http.Header{"If-Modified-Since": {lastModified}}, 304},
+		{"modified since", http.Header{"If-Modified-Since": {"Sun, 01 Jan 2006 15:04:05 GMT"}}, 200},
+		{"etag wins over date", http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {lastModified}}, 200},
+	}
+
+	for _, data := range testTable {
+		status, body, h := get(data.header)
+		if status != data.expectedStatus {
+			t.Errorf("%s: status: expected=%d got=%d", data.name, data.expectedStatus, status)
+		}
+		if status == 304 {
+			if body != "" {
+				t.Errorf("%s: non-empty body for 304: %q", data.name, body)
+			}
+			if h.Get("Etag") != etag {
+				t.Errorf("%s: etag: expected=%s got=%s", data.name, etag, h.Get("Etag"))
+			}
+		}
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	var fullResponses, notModifiedResponses int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModifiedResponses++
+			w.WriteHeader(304)
+			return
+		}
+		fullResponses++
+		fmt.Fprint(w, "config")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_TTL", "100ms")
+	t.Setenv("CACHE_STALE_RETENTION", "1m")
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	for i := range 3 {
+		if _, err := query("revalidate", "config", "http://localhost:8080/revalidate"); err != nil {
+			t.Errorf("query %d: %v", i, err)
+		}
+		time.Sleep(150 * time.Millisecond) // let the entry expire
+	}
+
+	if fullResponses != 1 {
+		t.Errorf("full responses: expected=1 got=%d", fullResponses)
+	}
+	if notModifiedResponses != 2 {
+		t.Errorf("not modified responses: expected=2 got=%d", notModifiedResponses)
+	}
+}
+
+func TestValidators(t *testing.T) {
+	generated := response{Body: []byte("config"), Header: http.Header{}, GeneratedETag: true}
+	generated.Header.Set("Etag", generateETag(generated.Body))
+	if h := validators(generated); h.Get("If-None-Match") != "" {
+		t.Errorf("generated etag sent to backend: %v", h)
+	}
+
+	backend := response{Body: []byte("config"), Header: http.Header{"Etag": {`"v1"`}}}
+	if h := validators(backend); h.Get("If-None-Match") != `"v1"` {
+		t.Errorf("backend etag not sent: %v", h)
+	}
+
+	refreshed := refreshStale(generated, http.Header{"Etag": {`"v2"`}})
+	if h := validators(refreshed); h.Get("If-None-Match") != `"v2"` {
+		t.Errorf("refreshed backend etag not sent: %v", h)
+	}
+}
+
+func TestStalePurgeGeneration(t *testing.T) {
+	s := newStaleStore(time.Minute, 1000)
+	expire := time.Now().Add(time.Minute)
+
+	generation := s.generation()
+	s.purge("key") // purged while fetching
+	s.put("key", response{Body: []byte("purged")}, expire, generation)
+	if _, found := s.get("key"); found {
+		t.Errorf("fetch started before purge was retained")
+	}
+
+	s.put("key", response{Body: []byte("fresh")}, expire, s.generation())
+	if e, found := s.get("key"); !found || string(e.resp.Body) != "fresh" {
+		t.Errorf("fetch started after purge was not retained")
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	const slowServerDelay = 100 * time.Millisecond
+
+	var version int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		time.Sleep(slowServerDelay)
+		version++
+		fmt.Fprintf(w, "v%d", version)
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_TTL", "100ms")
+	t.Setenv("CACHE_STALE_WHILE_REVALIDATE", "1m")
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	const u = "http://localhost:8080/swr"
+
+	if _, err := query("swr 1st", "v1", u); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(150 * time.Millisecond) // let the entry expire
+
+	// stale response served immediately, refresh in background
+	elap, err := query("swr 2nd", "v1", u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elap >= slowServerDelay {
+		t.Errorf("stale response too slow: %v >= %v", elap, slowServerDelay)
+	}
+
+	time.Sleep(2 * slowServerDelay) // wait background refresh
+
+	if _, err := query("swr 3rd", "v2", u); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	var backendDown bool
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		if backendDown {
+			respond(t, w, 503, "down")
+			return
+		}
+		respond(t, w, 200, "good")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_TTL", "100ms")
+	t.Setenv("CACHE_STALE_IF_ERROR", "1m")
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	const u = "http://localhost:8080/sie"
+
+	if _, err := query("sie 1st", "good", u); err != nil {
+		t.Fatal(err)
+	}
+
+	backendDown = true
+	time.Sleep(150 * time.Millisecond) // let the entry expire
+
+	resp, errGet := http.Get(u)
+	if errGet != nil {
+		t.Fatalf("get: %v", errGet)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 200 || string(body) != "good" {
+		t.Errorf("expected stale response: status=%d body=%q", resp.StatusCode, string(body))
+	}
+	if !strings.HasPrefix(resp.Header.Get("Warning"), "111") {
+		t.Errorf("missing stale warning: %q", resp.Header.Get("Warning"))
+	}
+}
+
+func TestPurge(t *testing.T) {
+	var hits int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		hits++
+		respond(t, w, 200, fmt.Sprintf("hit-%d", hits))
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_STALE_RETENTION", "1m")
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	const u = "http://localhost:8080/purge?a=1"
+
+	if _, err := query("purge 1st", "hit-1", u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query("purge cached", "hit-1", u); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := app.adminHandler()
+
+	{
+		req := httptest.NewRequest("POST", adminPurgePath, nil)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != 400 {
+			t.Errorf("purge without uri: expected status 400, got %d", rec.Code)
+		}
+	}
+
+	{
+		req := httptest.NewRequest("POST", adminPurgePath+"?uri="+url.QueryEscape("/purge?a=1"), nil)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("purge: status=%d body=%s", rec.Code, rec.Body.String())
+		}
+	}
+
+	if _, err := query("purge after", "hit-2", u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNamespacePurge(t *testing.T) {
+	hits := map[string]int{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		respond(t, w, 200, fmt.Sprintf("%s-%d", r.URL.Path, hits[r.URL.Path]))
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_NAMESPACES", `{"myapp": "^/prod/myapp"}`)
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	const (
+		inside  = "http://localhost:8080/prod/myapp/default"
+		outside = "http://localhost:8080/prod/other/default"
+	)
+
+	if _, err := query("ns inside 1st", "/prod/myapp/default-1", inside); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query("ns outside 1st", "/prod/other/default-1", outside); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := app.adminHandler()
+
+	{
+		req := httptest.NewRequest("POST", adminNamespacePurgePath+"?namespace=missing", nil)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != 404 {
+			t.Errorf("purge unknown namespace: expected status 404, got %d", rec.Code)
+		}
+	}
+
+	{
+		req := httptest.NewRequest("POST", adminNamespacePurgePath+"?namespace=myapp", nil)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("purge namespace: status=%d body=%s", rec.Code, rec.Body.String())
+		}
+	}
+
+	if _, err := query("ns inside purged", "/prod/myapp/default-2", inside); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query("ns outside cached", "/prod/other/default-1", outside); err != nil {
+		t.Fatal(err)
+	}
+
+	{
+		req := httptest.NewRequest("GET", adminNamespacesPath, nil)
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if body := strings.TrimSpace(rec.Body.String()); body != `{"myapp":1}` {
+			t.Errorf("namespaces: expected generation 1, got %s", body)
+		}
+	}
+}
+
+func TestSpringMonitor(t *testing.T) {
+	hits := map[string]int{}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		respond(t, w, 200, fmt.Sprintf("%s-%d", r.URL.Path, hits[r.URL.Path]))
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("SPRING_MONITOR_ENABLE", "true")
+	t.Setenv("ADMIN_ENABLE", "true")
+
+	os.Setenv("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", "true")
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	const (
+		foo = "http://localhost:8080/foo/prod/main"
+		bar = "http://localhost:8080/main/bar-prod.yml"
+	)
+
+	if _, err := query("spring foo 1st", "/foo/prod/main-1", foo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query("spring bar 1st", "/main/bar-prod.yml-1", bar); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := app.adminHandler()
+
+	monitor := func(payload string) {
+		req := httptest.NewRequest("POST", adminSpringMonitorPath, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Github-Event", "push")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("monitor: status=%d body=%s", rec.Code, rec.Body.String())
+		}
+	}
+
+	monitor(`{"commits":[{"modified":["foo-prod.yml"]}]}`)
+
+	if _, err := query("spring foo purged", "/foo/prod/main-2", foo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query("spring bar cached", "/main/bar-prod.yml-1", bar); err != nil {
+		t.Fatal(err)
+	}
+
+	monitor(`{"commits":[{"added":["application.yml"]}]}`)
+
+	if _, err := query("spring foo purged all", "/foo/prod/main-3", foo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query("spring bar purged all", "/main/bar-prod.yml-2", bar); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalCache(t *testing.T) {
+	var hits int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		hits++
+		respond(t, w, 200, fmt.Sprintf("hit-%d", hits))
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_IMPLEMENTATION", "local")
+
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	const u = "http://localhost:8080/local"
+
+	if _, err := query("local 1st", "hit-1", u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query("local cached", "hit-1", u); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := app.cache.Stats()
+	if stats.Gets != 2 || stats.Hits != 1 || stats.Loads != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	exported := &localGroupStatistics{name: "local", c: app.cache.(*localCache)}
+	if exported.Gets() != 2 || exported.CacheHits() != 1 || exported.LocalLoads() != 1 {
+		t.Errorf("unexpected exported stats: gets=%d hits=%d loads=%d",
+			exported.Gets(), exported.CacheHits(), exported.LocalLoads())
+	}
+
+	key := app.requestKey(httptest.NewRequest("GET", "/local", nil), "GET /local")
+	if err := app.cache.Remove(context.TODO(), key); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	if _, err := query("local removed", "hit-2", u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStandalone(t *testing.T) {
+	var hits int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		hits++
+		respond(t, w, 200, fmt.Sprintf("hit-%d", hits))
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("COMPUTE", "standalone")
+	t.Setenv("GROUPCACHE_SELF", "127.0.0.1:5000")
+
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	peers, _ := app.peers.list()
+	if !slices.Equal(peers, []string{"http://127.0.0.1:5000"}) {
+		t.Errorf("standalone: expected only self as peer, got %v", peers)
+	}
+
+	const u = "http://localhost:8080/standalone"
+
+	if _, err := query("standalone 1st", "hit-1", u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query("standalone cached", "hit-1", u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStandalone3(t *testing.T) {
+	os.Setenv("BACKEND_URL", "http://localhost:9999")
+	envCacheAnything()
+	t.Setenv("COMPUTE", "standalone")
+	t.Setenv("GROUPCACHE_VERSION", "3")
+	t.Setenv("GROUPCACHE_PORT", ":5003")
+	t.Setenv("GROUPCACHE_SELF", "")
+
+	app := newApplication("test")
+
+	peers, _ := app.peers.list()
+	if !slices.Equal(peers, []string{"127.0.0.1:5003"}) {
+		t.Errorf("standalone: expected loopback self as peer, got %v", peers)
+	}
+	app.stop()
+
+	// announce GROUPCACHE_SELF, listen on GROUPCACHE_PORT
+	t.Setenv("GROUPCACHE_SELF", "10.0.0.1:6000")
+
+	app = newApplication("test")
+	defer app.stop()
+
+	peers, _ = app.peers.list()
+	if !slices.Equal(peers, []string{"10.0.0.1:6000"}) {
+		t.Errorf("standalone: expected announced self as peer, got %v", peers)
+	}
+	conn, errDial := net.Dial("tcp", "127.0.0.1:5003")
+	if errDial != nil {
+		t.Fatalf("groupcache server not listening on GROUPCACHE_PORT: %v", errDial)
+	}
+	conn.Close()
+}
+
+func TestAdminPeers(t *testing.T) {
+	os.Setenv("BACKEND_URL", "http://localhost:9999")
+	envCacheAnything()
+	t.Setenv("COMPUTE", "static")
+	t.Setenv("GROUPCACHE_SELF", "127.0.0.1:5000")
+	t.Setenv("STATIC_PEERS", `["127.0.0.2:5000"]`)
+
+	app := newApplication("test")
+	defer app.stop()
+
+	req := httptest.NewRequest("GET", adminPeersPath+"?uri=/prod/app", nil)
+	rec := httptest.NewRecorder()
+	app.adminHandler().ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("peers: status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	var result peersResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("peers: json: %v", err)
+	}
+
+	expectedPeers := []string{"http://127.0.0.1:5000", "http://127.0.0.2:5000"}
+	if result.Self != "http://127.0.0.1:5000" || !slices.Equal(result.Peers, expectedPeers) {
+		t.Errorf("unexpected peers: %+v", result)
+	}
+	if result.Changed.IsZero() {
+		t.Errorf("missing peers change time")
+	}
+	if result.Key != "GET /prod/app" || result.Owner == "" {
+		t.Errorf("unexpected key owner: %+v", result)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	os.Setenv("BACKEND_URL", "http://localhost:9999")
+	envCacheAnything()
+	t.Setenv("COMPUTE", "static")
+	t.Setenv("GROUPCACHE_SELF", "127.0.0.1:5000")
+	t.Setenv("STATIC_PEERS", `["127.0.0.2:5000", "127.0.0.1:5001"]`)
+	t.Setenv("ADMIN_ADDR", ":8889")
+	t.Setenv("ADMIN_TOKEN", "secret")
+
+	app := newApplication("test")
+	defer app.stop()
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest("GET", adminPeersPath, nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		app.adminHandler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("auth=%q: expected=401 got=%d", auth, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", adminPeersPath, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	app.adminHandler().ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Errorf("valid token: expected=200 got=%d", rec.Code)
+	}
+
+	// static peers sharing the host are reached at their own admin port
+	urls, errURLs := app.peerAdminURLs()
+	if errURLs != nil {
+		t.Fatalf("peer admin urls: %v", errURLs)
+	}
+	expected := []string{"http://127.0.0.1:8890", "http://127.0.0.2:8889"}
+	if !slices.Equal(urls, expected) {
+		t.Errorf("peer admin urls: expected=%v got=%v", expected, urls)
+	}
+}
+
+func TestSpringMonitorSecret(t *testing.T) {
+	os.Setenv("BACKEND_URL", "http://localhost:9999")
+	envCacheAnything()
+	t.Setenv("COMPUTE", "standalone")
+	t.Setenv("GROUPCACHE_SELF", "")
+	t.Setenv("ADMIN_ENABLE", "true")
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	t.Setenv("SPRING_MONITOR_ENABLE", "true")
+	t.Setenv("SPRING_MONITOR_SECRET", "hook-secret")
+
+	app := newApplication("test")
+	defer app.stop()
+
+	const payload = `{"commits":[{"modified":["foo-prod.yml"]}]}`
+
+	mac := hmac.New(sha256.New, []byte("hook-secret"))
+	mac.Write([]byte(payload))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	table := []struct {
+		label  string
+		header string
+		value  string
+		status int
+	}{
+		{"none", "", "", http.StatusUnauthorized},
+		{"github bad signature", "X-Hub-Signature-256", "sha256=00", http.StatusUnauthorized},
+		{"github", "X-Hub-Signature-256", signature, http.StatusOK},
+		{"gitlab bad token", "X-Gitlab-Token", "wrong", http.StatusUnauthorized},
+		{"gitlab", "X-Gitlab-Token", "hook-secret", http.StatusOK},
+		{"bearer", "Authorization", "Bearer admin-secret", http.StatusOK},
+	}
+
+	for _, data := range table {
+		req := httptest.NewRequest("POST", adminSpringMonitorPath, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Github-Event", "push")
+		if data.header != "" {
+			req.Header.Set(data.header, data.value)
+		}
+		rec := httptest.NewRecorder()
+		app.adminHandler().ServeHTTP(rec, req)
+		if rec.Code != data.status {
+			t.Errorf("%s: expected status=%d got=%d: %s", data.label, data.status, rec.Code, rec.Body.String())
+		}
+	}
+
+	// other admin routes still require the bearer token
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", adminPeersPath, nil)
+	req.Header.Set("X-Gitlab-Token", "hook-secret")
+	app.adminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("peers with webhook secret: expected=401 got=%d", rec.Code)
+	}
+}
+
+func TestConfigReadinessPath(t *testing.T) {
+	cfg := config{healthPath: "/health", readinessPath: "/ready"}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	cfg.readinessPath = cfg.healthPath
+	if err := cfg.validate(); err == nil {
+		t.Errorf("expected error for READINESS_PATH equal to HEALTH_PATH")
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		if !healthy.Load() {
+			respond(t, w, 500, "down")
+			return
+		}
+		respond(t, w, 200, "up")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_IMPLEMENTATION", "local")
+	t.Setenv("BACKEND_PROBE_URL", "/actuator/health")
+	t.Setenv("BACKEND_PROBE_INTERVAL", "10ms")
+	t.Setenv("BACKEND_PROBE_FAILURES", "2")
+
+	app := newApplication("test")
+	defer app.stop()
+
+	time.Sleep(50 * time.Millisecond) // give time for the probe to run
+
+	ready := func(label string, expectStatus int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		app.handleReadiness(rec, httptest.NewRequest("GET", "/ready", nil))
+		if rec.Code != expectStatus {
+			t.Errorf("%s: expected status=%d got=%d: %s", label, expectStatus, rec.Code, rec.Body.String())
+		}
+	}
+
+	ready("backend up", 200)
+
+	healthy.Store(false)
+	time.Sleep(100 * time.Millisecond)
+	ready("backend down", 503)
+
+	healthy.Store(true)
+	time.Sleep(100 * time.Millisecond)
+	ready("backend recovered", 200)
+
+	pending := &application{peers: newPeerTracker("10.0.0.1:5000")}
+	if reasons := pending.notReady(); len(reasons) != 3 {
+		t.Errorf("expected not listening, discovery and namespace sync pending, got %v", reasons)
+	}
+}
+
+func TestReadinessStaleIfError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		respond(t, w, 500, "down")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_IMPLEMENTATION", "local")
+	t.Setenv("CACHE_STALE_IF_ERROR", "1m")
+	t.Setenv("BACKEND_PROBE_URL", "/actuator/health")
+	t.Setenv("BACKEND_PROBE_INTERVAL", "10ms")
+	t.Setenv("BACKEND_PROBE_FAILURES", "2")
+
+	app := newApplication("test")
+	defer app.stop()
+
+	time.Sleep(100 * time.Millisecond) // give time for the probe to fail
+
+	if f := app.ready.backendFailures.Load(); f < 2 {
+		t.Errorf("expected probe failures, got %d", f)
+	}
+
+	rec := httptest.NewRecorder()
+	app.handleReadiness(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != 200 {
+		t.Errorf("expected ready with stale-if-error, got status=%d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadinessNamespaceSync(t *testing.T) {
+	os.Setenv("BACKEND_URL", "http://localhost:9999")
+	envCacheAnything()
+	t.Setenv("CACHE_IMPLEMENTATION", "local")
+	t.Setenv("CACHE_NAMESPACES", `{"prod": "^/prod"}`)
+	t.Setenv("ADMIN_ENABLE", "true")
+
+	app := newApplication("test")
+	defer app.stop()
+
+	if !app.peers.waitDiscovered(context.Background()) {
+		t.Fatalf("discovery not delivered")
+	}
+	time.Sleep(50 * time.Millisecond) // give time for the first sync
+
+	if !app.ready.namespacesSynced.Load() {
+		t.Errorf("first namespace sync not done after discovery")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		respond(t, w, 200, "slow")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_IMPLEMENTATION", "local")
+	t.Setenv("SHUTDOWN_DRAIN_DELAY", "50ms")
+
+	app := newApplication("test")
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := query("drain in-flight", "slow", "http://localhost:8080/drain")
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond) // request in flight
+
+	app.stop()
+
+	if reasons := app.notReady(); !slices.Contains(reasons, "draining") {
+		t.Errorf("expected readiness to fail while draining, got %v", reasons)
+	}
+	if !app.waitFetches(time.Millisecond) {
+		t.Errorf("expected no fetches in flight after stop")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("in-flight request failed during drain: %v", err)
+	}
+}
+
+func TestDrainConcurrentFetches(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		respond(t, w, 200, "ok")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_IMPLEMENTATION", "local")
+	t.Setenv("SHUTDOWN_FETCH_TIMEOUT", "5s")
+
+	app := newApplication("test")
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	//
+	// keep fetching, like peers and background refreshes do, while stop
+	// waits for the fetches in flight.
+	//
+	quit := make(chan struct{})
+	var workers sync.WaitGroup
+	for i := range 8 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			key := fmt.Sprintf("GET /drain/%d", i)
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				app.fetchEntry(context.TODO(), key, staleEntry{}, false)
+			}
+		}()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		app.stop()
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond) // stop waiting for fetches
+	close(quit)
+	workers.Wait()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stop did not finish after the fetches ended")
+	}
+
+	if !app.waitFetches(time.Millisecond) {
+		t.Errorf("expected no fetches in flight after stop")
+	}
+}
+
+func TestCacheResult(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		respond(t, w, 200, "result")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_IMPLEMENTATION", "local")
+	t.Setenv("METRICS_ROUTE_SPRING", "true")
+
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	const u = "http://localhost:8080/myapp/default"
+
+	if _, err := query("result 1st", "result", u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := query("result cached", "result", u); err != nil {
+		t.Fatal(err)
+	}
+
+	const route = "/{application}/{profile}"
+	for _, result := range []string{cacheResultBackendLoad, cacheResultLocalHit} {
+		if n := testutil.ToFloat64(app.metrics.cacheResults.WithLabelValues("GET", route, result)); n != 1 {
+			t.Errorf("result=%s: expected count=1 got=%v", result, n)
+		}
+	}
+
+	rec := &cacheResultRecorder{}
+	if r := rec.result(nil, false); r != cacheResultHotHit {
+		t.Errorf("expected %s got %s", cacheResultHotHit, r)
+	}
+	rec.peerFetch.Store(true)
+	if r := rec.result(nil, false); r != cacheResultPeerHit {
+		t.Errorf("expected %s got %s", cacheResultPeerHit, r)
+	}
+	rec.loaded.Store(true)
+	if r := rec.result(nil, false); r != cacheResultBackendLoad {
+		t.Errorf("peer failed, loaded locally: expected %s got %s", cacheResultBackendLoad, r)
+	}
+	if r := rec.result(errors.New("boom"), true); r != cacheResultError {
+		t.Errorf("expected %s got %s", cacheResultError, r)
+	}
+}
+
+func TestBackendMetrics(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+		respond(t, w, 200, "backend")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("CACHE_IMPLEMENTATION", "local")
+	t.Setenv("METRICS_ROUTE_SPRING", "true")
+	t.Setenv("EMF_ENABLE", "true")
+
+	app := newApplication("test")
+	defer app.stop()
+
+	if _, _, err := app.fetchEntry(context.TODO(), "GET /myapp/default", staleEntry{}, false); err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+
+	backend := app.backendURL.Host
+	const route = "/{application}/{profile}"
+
+	if n := testutil.CollectAndCount(app.metrics.backendLatency); n != 1 {
+		t.Errorf("expected 1 latency series, got %d", n)
+	}
+	size := app.metrics.backendSize.WithLabelValues("GET", "200", route, backend).(prometheus.Histogram)
+	if n := testutil.CollectAndCount(size); n != 1 {
+		t.Errorf("expected size series for status 200, got %d", n)
+	}
+
+	if !app.emfPending {
+		t.Errorf("expected emf backend metrics pending export")
+	}
+	app.flushBackendEMF()
+	if app.emfPending {
+		t.Errorf("expected emf backend metrics exported")
+	}
+
+	//
+	// backend down
+	//
+	s.Close()
+
+	if _, _, err := app.fetchEntry(context.TODO(), "GET /myapp/prod", staleEntry{}, false); err == nil {
+		t.Fatalf("expected fetch error with backend down")
+	}
+	errs := app.metrics.backendErrors.WithLabelValues("GET", route, backend, "connection_refused")
+	if n := testutil.ToFloat64(errs); n != 1 {
+		t.Errorf("expected 1 connection_refused error, got %v", n)
+	}
+}
+
+func TestDiagnosticHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/other" {
+			// backend behind another cache
+			w.Header().Set("X-Cache", "HIT")
+			w.Header().Set("Age", "100")
+		}
+		respond(t, w, 200, "diag")
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	t.Setenv("RESTRICT_ROUTE_REGEXP", `["^/cached"]`)
+	t.Setenv("RESTRICT_METHOD", `[]`)
+	t.Setenv("CACHE_IMPLEMENTATION", "local")
+	t.Setenv("CACHE_DIAGNOSTIC_HEADERS", `["X-Cache", "Age", "X-Cache-TTL"]`)
+
+	app := newApplication("test")
+	defer app.stop()
+	go app.run()
+
+	time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+	get := func(label, path, expectXCache string) http.Header {
+		t.Helper()
+		resp, err := http.Get("http://localhost:8080" + path)
+		if err != nil {
+			t.Fatalf("%s: %v", label, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if xc := resp.Header.Get("X-Cache"); xc != expectXCache {
+			t.Errorf("%s: expected X-Cache=%s got=%s", label, expectXCache, xc)
+		}
+		return resp.Header
+	}
+
+	h := get("miss", "/cached", "MISS")
+	if age := h.Get("Age"); age != "0" {
+		t.Errorf("miss: expected Age=0 got=%s", age)
+	}
+	if ttl, _ := strconv.Atoi(h.Get("X-Cache-Ttl")); ttl <= 0 || ttl > 300 {
+		t.Errorf("miss: expected X-Cache-TTL within CACHE_TTL, got=%s", h.Get("X-Cache-Ttl"))
+	}
+
+	h = get("hit", "/cached", "HIT")
+	if h.Get("Age") == "" {
+		t.Errorf("hit: missing Age")
+	}
+
+	h = get("bypass", "/other", "BYPASS")
+	if h.Get("Age") != "" || h.Get("X-Cache-Ttl") != "" {
+		t.Errorf("bypass: unexpected Age or X-Cache-TTL: %v", h)
+	}
+	if xc := h.Values("X-Cache"); len(xc) != 1 {
+		t.Errorf("bypass: expected single X-Cache, got %v", xc)
+	}
+
+	stale := staleResponse(response{Header: http.Header{}, Fetched: time.Now().Add(-time.Minute)}, `110 - "Response is Stale"`)
+	if xc := xCache(cacheResultLocalHit, stale.Stale); xc != "STALE" {
+		t.Errorf("stale: expected X-Cache=STALE got=%s", xc)
+	}
+	if a, known := age(stale, time.Now()); !known || a < 60 {
+		t.Errorf("stale: expected Age from original fetch, got=%d known=%t", a, known)
+	}
+}
+
+func TestNoStore(t *testing.T) {
+	for _, impl := range []string{"groupcache", "local"} {
+		var hits int
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ /*r*/ *http.Request) {
+			hits++
+			w.Header().Set("Cache-Control", "no-store")
+			respond(t, w, 200, fmt.Sprintf("hit-%d", hits))
+		}))
+
+		os.Setenv("BACKEND_URL", s.URL)
+		envCacheAnything()
+		t.Setenv("CACHE_HONOR_CACHE_CONTROL", "true")
+		t.Setenv("CACHE_IMPLEMENTATION", impl)
+		t.Setenv("COMPUTE", "standalone")
+		t.Setenv("GROUPCACHE_SELF", "127.0.0.1:5000")
+
+		app := newApplication("test")
+		go app.run()
+
+		time.Sleep(100 * time.Millisecond) // give time for the application to start
+
+		const u = "http://localhost:8080/nostore"
+
+		for _, expected := range []string{"hit-1", "hit-2", "hit-3"} {
+			if _, err := query(impl+" no-store", expected, u); err != nil {
+				t.Error(err)
+			}
+		}
+
+		if stats := app.cache.Stats(); stats.Items != 0 {
+			t.Errorf("%s: no-store response stored: items=%d", impl, stats.Items)
+		}
+
+		app.stop()
+		s.Close()
+	}
+}
+
+func TestStaticPeers(t *testing.T) {
+	table := []struct {
+		list     []string
+		expected []string
+	}{
+		{nil, []string{"10.0.0.1:5000"}},
+		{[]string{"10.0.0.1:5000", "10.0.0.2:5000"}, []string{"10.0.0.1:5000", "10.0.0.2:5000"}},
+		{[]string{"http://10.0.0.3:5000/", "10.0.0.2", " "}, []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000"}},
+	}
+	for _, data := range table {
+		addrs := peerAddresses(data.list, ":5000", "10.0.0.1:5000")
+		if !slices.Equal(addrs, data.expected) {
+			t.Errorf("%v: expected=%v got=%v", data.list, data.expected, addrs)
+		}
+	}
+}
+
+func TestNotStoredTwoPeers(t *testing.T) {
+	var hits atomic.Int64
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if strings.HasPrefix(r.URL.Path, "/nostore") {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		respond(t, w, 200, "body "+r.URL.Path)
+	}))
+	defer s.Close()
+
+	os.Setenv("BACKEND_URL", s.URL)
+	envCacheAnything()
+	t.Setenv("GROUPCACHE_VERSION", "3")
+	t.Setenv("COMPUTE", "static")
+	t.Setenv("STATIC_PEERS", `["127.0.0.1:5011", "127.0.0.1:5012"]`)
+	t.Setenv("CACHE_STALE_IF_ERROR", "1m")
+	t.Setenv("CACHE_HONOR_CACHE_CONTROL", "true")
+
+	newPeer := func(port string) *application {
+		t.Setenv("GROUPCACHE_PORT", ":"+port)
+		t.Setenv("GROUPCACHE_SELF", "127.0.0.1:"+port)
+		return newApplication("test")
+	}
+	app1 := newPeer("5011")
+	defer app1.stop()
+	app2 := newPeer("5012")
+	defer app2.stop()
+
+	// find keys owned by the other peer
+	remoteKey := func(prefix string) string {
+		for i := range 100 {
+			key := buildKey("GET", fmt.Sprintf("%s/%d", prefix, i), nil)
+			if !app1.peers.owns(key) {
+				return key
+			}
+		}
+		t.Fatalf("no key owned by the other peer")
+		return ""
+	}
+
+	nostore := remoteKey("/nostore")
+	for i := range 3 {
+		resp, err := app1.query(context.TODO(), nostore, "")
+		if err != nil {
+			t.Fatalf("no-store query: %v", err)
+		}
+		if !strings.HasPrefix(string(resp.Body), "body /nostore/") {
+			t.Errorf("no-store: unexpected body: %q", string(resp.Body))
+		}
+		if n := hits.Load(); n != int64(i+1) {
+			t.Errorf("no-store request %d: expected backend hits=%d got=%d", i+1, i+1, n)
+		}
+	}
+	if n := app1.cache.Stats().PeerErrors; n != 0 {
+		t.Errorf("no-store: expected no peer errors, got %d", n)
+	}
+
+	cached := remoteKey("/cached")
+	if _, err := app1.query(context.TODO(), cached, ""); err != nil {
+		t.Fatalf("cached query: %v", err)
+	}
+	if _, found := app1.stale.get(cached); found {
+		t.Errorf("non-owner retained the stale entry")
+	}
+	if _, found := app2.stale.get(cached); !found {
+		t.Errorf("owner did not retain the stale entry")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/udhos/aws-emf/emf"
+)
+
+// backendFetch describes a request sent to the backend.
+type backendFetch struct {
+	method  string
+	path    string
+	status  int
+	bytes   int
+	elapsed time.Duration
+	err     error
+}
+
+// backendErrorType classifies backend request errors into a bounded set
+// of metric label values.
+func backendErrorType(err error) string {
+	var errDNS *net.DNSError
+	var errNet net.Error
+	switch {
+	case errors.As(err, &errDNS):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	case errors.As(err, &errNet) && errNet.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// recordBackendFetch exports the backend request to Prometheus, Dogstatsd
+// and AWS CloudWatch EMF, as enabled. The status is "error" when the request
+// failed without response.
+func (app *application) recordBackendFetch(f backendFetch) {
+	route := app.metricsRoutes.route(f.path)
+	backend := app.backendURL.Host
+
+	status := strconv.Itoa(f.status)
+	var errType string
+	if f.err != nil {
+		status = "error"
+		errType = backendErrorType(f.err)
+	}
+
+	if app.cfg.prometheusEnable {
+		app.metrics.recordBackend(f.method, status, route, backend, errType, f.bytes, f.elapsed)
+	}
+
+	if app.dogstatsdClient != nil {
+		tags := []string{"method:" + f.method, "status:" + status, "uri:" + route, "backend:" + backend}
+		sec := float64(f.elapsed) / float64(time.Second)
+		if errDd := app.dogstatsdClient.Distribution("backend_requests_seconds", sec, tags, 1); errDd != nil {
+			log.Error().Msgf("dogstatsd backend_requests_seconds: %v", errDd)
+		}
+		if f.err != nil {
+			if errDd := app.dogstatsdClient.Incr("backend_errors", append(tags, "error:"+errType), 1); errDd != nil {
+				log.Error().Msgf("dogstatsd backend_errors: %v", errDd)
+			}
+		} else {
+			if errDd := app.dogstatsdClient.Distribution("backend_response_bytes", float64(f.bytes), tags, 1); errDd != nil {
+				log.Error().Msgf("dogstatsd backend_response_bytes: %v", errDd)
+			}
+		}
+	}
+
+	if app.emf != nil {
+		app.recordBackendEMF(f, status, route, backend, errType)
+	}
+}
+
+// startBackendEMF records backend requests with the EMF library and exports
+// them every emfExportInterval, like the groupcache EMF exporter: to stdout,
+// extracted from the container logs by CloudWatch, or, with EMF_SEND_LOGS,
+// directly to CloudWatch Logs.
+func (app *application) startBackendEMF() func() {
+	if !app.cfg.emfEnable {
+		return func() {}
+	}
+
+	var opt emf.Options
+	if app.cfg.emfSendLogs {
+		awsConfig := getAwsConfig()
+		opt.AwsConfig = &awsConfig
+		opt.LogGroup = "/kubecache"
+	}
+	app.emf = emf.New(opt)
+
+	stop := poll(emfExportInterval, func(_ context.Context) { app.flushBackendEMF() })
+
+	return func() {
+		stop()
+		app.flushBackendEMF()
+	}
+}
+
+// recordBackendEMF adds the backend request to the metrics pending export.
+func (app *application) recordBackendEMF(f backendFetch, status, route, backend, errType string) {
+	namespace := app.cfg.metricsNamespace
+	if namespace == "" {
+		namespace = "kubecache"
+	}
+
+	dimensions := map[string]string{
+		"method":  f.method,
+		"uri":     route,
+		"backend": backend,
+		"status":  status,
+	}
+
+	app.emfMutex.Lock()
+	defer app.emfMutex.Unlock()
+
+	app.emf.Record(namespace, emf.MetricDefinition{Name: "backend_request_duration", Unit: "Milliseconds"},
+		dimensions, float64(f.elapsed)/float64(time.Millisecond))
+
+	if f.err != nil {
+		errDimensions := maps.Clone(dimensions)
+		errDimensions["error"] = errType
+		app.emf.Record(namespace, emf.MetricDefinition{Name: "backend_errors", Unit: "Count"},
+			errDimensions, 1)
+	} else {
+		app.emf.Record(namespace, emf.MetricDefinition{Name: "backend_response_size", Unit: "Bytes"},
+			dimensions, f.bytes)
+	}
+
+	app.emfPending = true
+}
+
+// flushBackendEMF exports the metrics recorded since the last export, if any.
+func (app *application) flushBackendEMF() {
+	app.emfMutex.Lock()
+	defer app.emfMutex.Unlock()
+
+	if !app.emfPending {
+		return
+	}
+	app.emfPending = false
+
+	if app.cfg.emfSendLogs {
+		if errSend := app.emf.CloudWatchSend(); errSend != nil {
+			log.Error().Msgf("emf backend metrics: %v", errSend)
+		}
+		return
+	}
+
+	app.emf.Println()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// cache stores the encoded backend responses, loading missing keys
+// with app.cacheGetter. Implementations: groupcache2, groupcache3 and
+// the in-process local cache.
+type cache interface {
+	// Get returns the encoded response for key.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Remove drops the key from the cache, on every peer.
+	Remove(ctx context.Context, key string) error
+
+	// Stats reports the cache statistics.
+	Stats() cacheStats
+
+	// Close stops peer discovery, metrics exporters and servers.
+	Close()
+}
+
+// cacheStats are the statistics common to all cache implementations.
+// Bytes, Items and Evictions sum the main and hot caches. groupcache3
+// reports no peer statistics.
+type cacheStats struct {
+	Gets       int64 `json:"gets"`
+	Hits       int64 `json:"hits"`
+	Loads      int64 `json:"loads"`
+	PeerLoads  int64 `json:"peer_loads"`
+	PeerErrors int64 `json:"peer_errors"`
+	LoadErrors int64 `json:"load_errors"`
+	Bytes      int64 `json:"bytes"`
+	Items      int64 `json:"items"`
+	Evictions  int64 `json:"evictions"`
+}
+
+// newCache creates the cache implementation selected by CACHE_IMPLEMENTATION
+// and GROUPCACHE_VERSION.
+func newCache(app *application) cache {
+	if app.cfg.cacheImplementation == "local" {
+		return newLocalCache(app)
+	}
+	if app.cfg.groupcacheVersion == 3 {
+		return startGroupcache3(app)
+	}
+	return startGroupcache(app)
+}
+
+// cacheGetter loads the key on a cache miss, returning the encoded response
+// and its expiration.
+func (app *application) cacheGetter(c context.Context, key string) ([]byte, time.Time, error) {
+	const me = "groupcache.getter"
+	ctx, span := app.tracer.Start(c, me)
+	defer span.End()
+
+	recordLoad(ctx)
+
+	return app.loadEntry(ctx, key)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/groupcache/groupcache-go/v3"
+	"github.com/groupcache/groupcache-go/v3/transport"
+)
+
+// expiringCache is the groupcache3 main and hot cache, and the store for
+// the local cache. Like groupcache2, it periodically evicts expired keys,
+// instead of waiting for them to be accessed or to reach the LRU tail.
+type expiringCache struct {
+	mu        sync.Mutex
+	maxBytes  int64 // zero means unbounded
+	bytes     int64
+	lru       *list.List // front is most recently used
+	items     map[string]*list.Element
+	gets      int64
+	hits      int64
+	evictions int64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type expiringCacheEntry struct {
+	key   string
+	value transport.ByteView
+}
+
+func newExpiringCache(maxBytes int64, purgeExpired bool, evictionInterval time.Duration) *expiringCache {
+	c := &expiringCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+		done:     make(chan struct{}),
+	}
+	if purgeExpired && evictionInterval > 0 {
+		go c.evictExpiredLoop(evictionInterval)
+	}
+	return c
+}
+
+func (c *expiringCache) evictExpiredLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.evictExpired()
+		}
+	}
+}
+
+// evictExpired removes every expired key.
+func (c *expiringCache) evictExpired() {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if expired(elem.Value.(*expiringCacheEntry).value, now) {
+			c.removeElement(elem)
+		}
+		elem = next
+	}
+}
+
+func expired(v transport.ByteView, now time.Time) bool {
+	expire := v.Expire()
+	return !expire.IsZero() && now.After(expire)
+}
+
+func (c *expiringCache) Get(key string) (transport.ByteView, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gets++
+
+	elem, found := c.items[key]
+	if !found {
+		return transport.ByteView{}, false
+	}
+	e := elem.Value.(*expiringCacheEntry)
+	if expired(e.value, time.Now()) {
+		c.removeElement(elem)
+		return transport.ByteView{}, false
+	}
+	c.lru.MoveToFront(elem)
+	c.hits++
+	return e.value, true
+}
+
+func (c *expiringCache) Add(key string, value transport.ByteView) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.items[key]; found {
+		e := elem.Value.(*expiringCacheEntry)
+		c.bytes += int64(value.Len() - e.value.Len())
+		e.value = value
+		c.lru.MoveToFront(elem)
+	} else {
+		c.items[key] = c.lru.PushFront(&expiringCacheEntry{key: key, value: value})
+		c.bytes += int64(len(key) + value.Len())
+	}
+
+	for c.maxBytes > 0 && c.bytes > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *expiringCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.items[key]; found {
+		c.lru.Remove(elem)
+		delete(c.items, key)
+		c.bytes -= int64(len(key) + elem.Value.(*expiringCacheEntry).value.Len())
+	}
+}
+
+// removeElement evicts the element. Must be called with lock held.
+func (c *expiringCache) removeElement(elem *list.Element) {
+	e := c.lru.Remove(elem).(*expiringCacheEntry)
+	delete(c.items, e.key)
+	c.bytes -= int64(len(e.key) + e.value.Len())
+	c.evictions++
+}
+
+func (c *expiringCache) Stats() groupcache.CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return groupcache.CacheStats{
+		Bytes:     c.bytes,
+		Items:     int64(c.lru.Len()),
+		Gets:      c.gets,
+		Hits:      c.hits,
+		Evictions: c.evictions,
+	}
+}
+
+func (c *expiringCache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+func (c *expiringCache) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// expiringCacheFactory creates the groupcache3 caches, keeping track of
+// them since groupcache3 never closes its caches.
+type expiringCacheFactory struct {
+	mu               sync.Mutex
+	caches           []*expiringCache
+	purgeExpired     bool
+	evictionInterval time.Duration
+}
+
+func (f *expiringCacheFactory) newCache(maxBytes int64) (groupcache.Cache, error) {
+	c := newExpiringCache(maxBytes, f.purgeExpired, f.evictionInterval)
+	f.mu.Lock()
+	f.caches = append(f.caches, c)
+	f.mu.Unlock()
+	return c, nil
+}
+
+// close stops the background eviction of all caches.
+func (f *expiringCacheFactory) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.caches {
+		c.Close()
+	}
+}
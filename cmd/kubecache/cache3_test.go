@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/groupcache/groupcache-go/v3/transport"
+)
+
+func TestExpiringCache(t *testing.T) {
+	c := newExpiringCache(0, false, 0)
+	defer c.Close()
+
+	now := time.Now()
+
+	c.Add("fresh", transport.ByteViewWithExpire([]byte("a"), now.Add(time.Hour)))
+	c.Add("expired", transport.ByteViewWithExpire([]byte("b"), now.Add(-time.Second)))
+	c.Add("forever", transport.ByteViewWithExpire([]byte("c"), time.Time{}))
+
+	if _, found := c.Get("fresh"); !found {
+		t.Errorf("fresh key not found")
+	}
+	if _, found := c.Get("forever"); !found {
+		t.Errorf("key without expiration not found")
+	}
+	if _, found := c.Get("expired"); found {
+		t.Errorf("expired key found")
+	}
+
+	c.Add("expired", transport.ByteViewWithExpire([]byte("b"), now.Add(-time.Second)))
+	c.evictExpired()
+
+	stats := c.Stats()
+	if stats.Items != 2 {
+		t.Errorf("expected 2 items after evicting expired keys, got %d", stats.Items)
+	}
+	if stats.Bytes != int64(len("fresh")+1+len("forever")+1) {
+		t.Errorf("unexpected bytes: %d", stats.Bytes)
+	}
+}
+
+func TestExpiringCacheMaxBytes(t *testing.T) {
+	c := newExpiringCache(10, false, 0)
+	defer c.Close()
+
+	c.Add("k1", transport.ByteViewWithExpire([]byte("123"), time.Time{})) // 5 bytes
+	c.Add("k2", transport.ByteViewWithExpire([]byte("123"), time.Time{})) // 10 bytes
+	c.Get("k1")                                                           // k2 becomes oldest
+	c.Add("k3", transport.ByteViewWithExpire([]byte("123"), time.Time{})) // evicts k2
+
+	if _, found := c.Get("k2"); found {
+		t.Errorf("least recently used key not evicted")
+	}
+	if _, found := c.Get("k1"); !found {
+		t.Errorf("recently used key evicted")
+	}
+	if c.Bytes() != 10 {
+		t.Errorf("expected 10 bytes, got %d", c.Bytes())
+	}
+}
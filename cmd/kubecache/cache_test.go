@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/groupcache/groupcache-go/v3"
+	"github.com/groupcache/groupcache-go/v3/transport"
+)
+
+func TestGroupcache3Stats(t *testing.T) {
+	instance := groupcache.New(groupcache.Options{})
+
+	getter := groupcache.GetterFunc(func(_ context.Context, key string, dest transport.Sink) error {
+		return dest.SetString("value-"+key, time.Now().Add(time.Minute))
+	})
+
+	group, errGroup := instance.NewGroup("stats", 1_000_000, getter)
+	if errGroup != nil {
+		t.Fatalf("new group: %v", errGroup)
+	}
+
+	c := &groupcache3Cache{group: group, close: func() {}}
+
+	for range 3 {
+		if _, err := c.Get(context.TODO(), "key"); err != nil {
+			t.Fatalf("get: %v", err)
+		}
+	}
+
+	s := c.Stats()
+	if s.Gets != 3 || s.Hits != 2 || s.Items != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
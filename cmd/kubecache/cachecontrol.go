@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the caching directives found in backend response headers.
+type cacheControl struct {
+	noStore    bool
+	noCache    bool
+	private    bool
+	maxAge     time.Duration
+	hasMaxAge  bool
+	sMaxAge    time.Duration
+	hasSMaxAge bool
+}
+
+func parseCacheControl(h http.Header) cacheControl {
+	var cc cacheControl
+	for _, line := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			switch name {
+			case "no-store":
+				cc.noStore = true
+			case "no-cache":
+				cc.noCache = true
+			case "private":
+				cc.private = true
+			case "max-age":
+				if d, ok := parseDeltaSeconds(value); ok {
+					cc.maxAge = d
+					cc.hasMaxAge = true
+				}
+			case "s-maxage":
+				if d, ok := parseDeltaSeconds(value); ok {
+					cc.sMaxAge = d
+					cc.hasSMaxAge = true
+				}
+			}
+		}
+	}
+	return cc
+}
+
+func parseDeltaSeconds(s string) (time.Duration, bool) {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || sec < 0 {
+		return 0, false
+	}
+	return time.Duration(sec) * time.Second, true
+}
+
+// responseTTL computes for how long a backend response should be cached.
+// If the backend response carries no usable caching directive, defaultTTL is
+// returned as is. Otherwise the TTL derived from the headers is clamped
+// between minTTL and maxTTL (zero maxTTL means no upper bound).
+// store is false when the response must not be cached at all.
+func responseTTL(h http.Header, now time.Time, defaultTTL, minTTL,
+	maxTTL time.Duration) (ttl time.Duration, store bool) {
+
+	cc := parseCacheControl(h)
+
+	if cc.noStore || cc.private {
+		return 0, false
+	}
+
+	switch {
+	case cc.noCache:
+		// we do not revalidate on every request, so treat as already stale
+		ttl = 0
+	case cc.hasSMaxAge:
+		// s-maxage is meant for shared caches and overrides max-age
+		ttl = cc.sMaxAge
+	case cc.hasMaxAge:
+		ttl = cc.maxAge
+	default:
+		expires := h.Get("Expires")
+		if expires == "" {
+			return defaultTTL, true
+		}
+		exp, errExp := http.ParseTime(expires)
+		if errExp != nil {
+			// invalid Expires means already expired: RFC 9111 5.3
+			ttl = 0
+			break
+		}
+		date := now
+		if d, errDate := http.ParseTime(h.Get("Date")); errDate == nil {
+			date = d
+		}
+		ttl = max(exp.Sub(date), 0)
+	}
+
+	ttl = max(ttl, minTTL)
+	if maxTTL > 0 {
+		ttl = min(ttl, maxTTL)
+	}
+
+	return ttl, true
+}
+
+// entryExpire returns the expiration time for storing a backend response
+// into groupcache, and whether the response may be stored at all.
+func (app *application) entryExpire(key string, resp response, isErrorStatus bool) (time.Time, bool) {
+	now := time.Now()
+
+	_, _, keyHeader, errKey := parseKey("entryExpire", app.backendURL, key)
+	if errKey != nil || !varyCovered(keyHeader, resp.Header, app.forwardDeny) {
+		//
+		// response varies on headers missing from the key
+		//
+		return time.Time{}, false
+	}
+
+	var ttl time.Duration
+	if isErrorStatus {
+		ttl = app.cfg.cacheErrorTTL
+	} else {
+		ttl = app.cfg.cacheTTL
+	}
+
+	if !app.cfg.cacheHonorCacheControl {
+		return now.Add(ttl), true
+	}
+
+	ttl, store := responseTTL(resp.Header, now, ttl, app.cfg.cacheTTLMin,
+		app.cfg.cacheTTLMax)
+	if !store {
+		return time.Time{}, false
+	}
+
+	return now.Add(ttl), true
+}
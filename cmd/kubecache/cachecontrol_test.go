@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+type ttlTestCase struct {
+	name          string
+	header        http.Header
+	minTTL        time.Duration
+	maxTTL        time.Duration
+	expectedTTL   time.Duration
+	expectedStore bool
+}
+
+var ttlTestTable = []ttlTestCase{
+	{
+		name:          "no headers uses default",
+		header:        http.Header{},
+		expectedTTL:   300 * time.Second,
+		expectedStore: true,
+	},
+	{
+		name:          "max-age",
+		header:        http.Header{"Cache-Control": {"public, max-age=60"}},
+		expectedTTL:   60 * time.Second,
+		expectedStore: true,
+	},
+	{
+		name:          "s-maxage overrides max-age",
+		header:        http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}},
+		expectedTTL:   120 * time.Second,
+		expectedStore: true,
+	},
+	{
+		name:          "no-store",
+		header:        http.Header{"Cache-Control": {"no-store"}},
+		expectedTTL:   0,
+		expectedStore: false,
+	},
+	{
+		name:          "private",
+		header:        http.Header{"Cache-Control": {"private, max-age=60"}},
+		expectedTTL:   0,
+		expectedStore: false,
+	},
+	{
+		name:          "no-cache",
+		header:        http.Header{"Cache-Control": {"no-cache, max-age=60"}},
+		expectedTTL:   0,
+		expectedStore: true,
+	},
+	{
+		name:          "no-cache clamped by min",
+		header:        http.Header{"Cache-Control": {"no-cache"}},
+		minTTL:        5 * time.Second,
+		expectedTTL:   5 * time.Second,
+		expectedStore: true,
+	},
+	{
+		name:          "max-age clamped by max",
+		header:        http.Header{"Cache-Control": {"max-age=86400"}},
+		maxTTL:        time.Hour,
+		expectedTTL:   time.Hour,
+		expectedStore: true,
+	},
+	{
+		name: "expires relative to date",
+		header: http.Header{
+			"Date":    {"Mon, 02 Jan 2006 15:04:05 GMT"},
+			"Expires": {"Mon, 02 Jan 2006 15:14:05 GMT"},
+		},
+		expectedTTL:   10 * time.Minute,
+		expectedStore: true,
+	},
+	{
+		name:          "invalid expires",
+		header:        http.Header{"Expires": {"0"}},
+		expectedTTL:   0,
+		expectedStore: true,
+	},
+}
+
+func TestResponseTTL(t *testing.T) {
+	const defaultTTL = 300 * time.Second
+	now := time.Now()
+	for _, data := range ttlTestTable {
+		ttl, store := responseTTL(data.header, now, defaultTTL, data.minTTL, data.maxTTL)
+		if store != data.expectedStore {
+			t.Errorf("%s: store: expected=%t got=%t", data.name, data.expectedStore, store)
+		}
+		if ttl != data.expectedTTL {
+			t.Errorf("%s: ttl: expected=%v got=%v", data.name, data.expectedTTL, ttl)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+// Cache results: where the response for a request came from.
+const (
+	cacheResultLocalHit    = "local_hit"    // main cache of the key owner
+	cacheResultHotHit      = "hot_hit"      // hot cache of a key owned by a peer
+	cacheResultPeerHit     = "peer_hit"     // fetched from the key owner
+	cacheResultBackendLoad = "backend_load" // loaded from the backend
+	cacheResultBypass      = "bypass"       // not cacheable, proxied
+	cacheResultError       = "error"
+)
+
+// cacheResultRecorder travels in the request context, recording the cache
+// activity on behalf of the request. Requests deduplicated with a concurrent
+// load of the same key record nothing, and are classified as hits.
+type cacheResultRecorder struct {
+	loaded    atomic.Bool // getter called
+	peerFetch atomic.Bool // peer requested
+}
+
+type cacheResultKey struct{}
+
+func withCacheResult(ctx context.Context) (context.Context, *cacheResultRecorder) {
+	rec := &cacheResultRecorder{}
+	return context.WithValue(ctx, cacheResultKey{}, rec), rec
+}
+
+// recordLoad and recordPeerFetch are safe to call on contexts without
+// recorder, like the requests received from peers.
+func recordLoad(ctx context.Context) {
+	if rec, ok := ctx.Value(cacheResultKey{}).(*cacheResultRecorder); ok {
+		rec.loaded.Store(true)
+	}
+}
+
+func recordPeerFetch(ctx context.Context) {
+	if rec, ok := ctx.Value(cacheResultKey{}).(*cacheResultRecorder); ok {
+		rec.peerFetch.Store(true)
+	}
+}
+
+// result classifies the request. A load takes precedence over a peer fetch,
+// since groupcache falls back to loading locally when the peer fails.
+func (rec *cacheResultRecorder) result(errGet error, owned bool) string {
+	switch {
+	case errGet != nil:
+		return cacheResultError
+	case rec.loaded.Load():
+		return cacheResultBackendLoad
+	case rec.peerFetch.Load():
+		return cacheResultPeerHit
+	case owned:
+		return cacheResultLocalHit
+	}
+	return cacheResultHotHit
+}
+
+// peerRoundTripper records the requests sent to peers.
+type peerRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (t *peerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet {
+		recordPeerFetch(req.Context())
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Cached responses are encoded in a compact binary format, since JSON
+// base64-encodes the body, inflating entries by a third. Decoding detects
+// the format from the first byte, so JSON entries cached by previous
+// versions remain readable during rollouts.
+//
+// Binary format, version 1:
+//
+//	version  byte (1)
+//	flags    byte (stale, fetched, expire, generated etag)
+//	status   uvarint
+//	fetched  varint unix nanoseconds, if flagged
+//	expire   varint unix nanoseconds, if flagged
+//	headers  uvarint count, then per header: name, uvarint count, values
+//	body     remaining bytes
+//
+// Strings are uvarint length followed by the bytes.
+const (
+	responseFormatBinaryV1 = 1
+	responseFormatJSON     = '{'
+)
+
+const (
+	responseFlagStale = 1 << iota
+	responseFlagFetched
+	responseFlagExpire
+	responseFlagGeneratedETag
+)
+
+var errResponseTruncated = errors.New("truncated response")
+
+// encodeResponse encodes the response for the cache, in the format selected
+// by CACHE_ENCODING.
+func (app *application) encodeResponse(resp response) ([]byte, error) {
+	if app.cfg.cacheEncoding == "json" {
+		return json.Marshal(resp)
+	}
+	return encodeResponseBinary(resp), nil
+}
+
+func encodeResponseBinary(resp response) []byte {
+	size := 2 + 3*binary.MaxVarintLen64 + len(resp.Body)
+	for k, v := range resp.Header {
+		size += len(k) + 2*binary.MaxVarintLen64
+		for _, vv := range v {
+			size += len(vv) + binary.MaxVarintLen64
+		}
+	}
+	buf := make([]byte, 0, size)
+
+	var flags byte
+	if resp.Stale {
+		flags |= responseFlagStale
+	}
+	if !resp.Fetched.IsZero() {
+		flags |= responseFlagFetched
+	}
+	if !resp.Expire.IsZero() {
+		flags |= responseFlagExpire
+	}
+	if resp.GeneratedETag {
+		flags |= responseFlagGeneratedETag
+	}
+
+	buf = append(buf, responseFormatBinaryV1, flags)
+	buf = binary.AppendUvarint(buf, uint64(resp.Status))
+	if !resp.Fetched.IsZero() {
+		buf = binary.AppendVarint(buf, resp.Fetched.UnixNano())
+	}
+	if !resp.Expire.IsZero() {
+		buf = binary.AppendVarint(buf, resp.Expire.UnixNano())
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(resp.Header)))
+	for _, name := range slices.Sorted(maps.Keys(resp.Header)) {
+		values := resp.Header[name]
+		buf = appendString(buf, name)
+		buf = binary.AppendUvarint(buf, uint64(len(values)))
+		for _, v := range values {
+			buf = appendString(buf, v)
+		}
+	}
+
+	return append(buf, resp.Body...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// decodeResponse decodes the response in either binary or JSON format.
+func decodeResponse(data []byte) (response, error) {
+	var resp response
+
+	if len(data) == 0 {
+		return resp, errResponseTruncated
+	}
+
+	switch data[0] {
+	case responseFormatJSON:
+		err := json.Unmarshal(data, &resp)
+		return resp, err
+	case responseFormatBinaryV1:
+		return decodeResponseBinary(data[1:])
+	}
+
+	return resp, fmt.Errorf("unknown response format: %d", data[0])
+}
+
+func decodeResponseBinary(data []byte) (response, error) {
+	var resp response
+	d := decoder{data: data}
+
+	flags := d.byte()
+	resp.Stale = flags&responseFlagStale != 0
+	resp.GeneratedETag = flags&responseFlagGeneratedETag != 0
+	resp.Status = int(d.uvarint())
+	if flags&responseFlagFetched != 0 {
+		resp.Fetched = time.Unix(0, d.varint())
+	}
+	if flags&responseFlagExpire != 0 {
+		resp.Expire = time.Unix(0, d.varint())
+	}
+
+	headers := d.uvarint()
+	if d.err == nil && headers > uint64(len(d.data)) {
+		d.err = errResponseTruncated // each header takes at least one byte
+	}
+	if d.err == nil {
+		resp.Header = make(http.Header, headers)
+	}
+	for i := uint64(0); i < headers && d.err == nil; i++ {
+		name := d.string()
+		count := d.uvarint()
+		if d.err == nil && count > uint64(len(d.data)) {
+			d.err = errResponseTruncated
+		}
+		if d.err != nil {
+			break
+		}
+		values := make([]string, 0, count)
+		for j := uint64(0); j < count && d.err == nil; j++ {
+			values = append(values, d.string())
+		}
+		resp.Header[name] = values
+	}
+
+	if d.err != nil {
+		return response{}, d.err
+	}
+
+	resp.Body = d.data
+
+	return resp, nil
+}
+
+// decoder reads the binary format, recording the first error.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) < 1 {
+		d.err = errResponseTruncated
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errResponseTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errResponseTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	size := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if size > uint64(len(d.data)) {
+		d.err = errResponseTruncated
+		return ""
+	}
+	s := string(d.data[:size])
+	d.data = d.data[size:]
+	return s
+}
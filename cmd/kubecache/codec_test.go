@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func codecTestResponse() response {
+	return response{
+		Body:   []byte(strings.Repeat(`{"name":"myapp","profiles":["default"],"propertySources":[]}`, 128)),
+		Status: 200,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+			"Etag":         []string{`"abc123"`},
+			"Vary":         []string{"Accept", "Accept-Encoding"},
+		},
+		Fetched: time.Unix(0, time.Now().UnixNano()),
+		Expire:  time.Unix(0, time.Now().Add(5*time.Minute).UnixNano()),
+	}
+}
+
+// sameResponse compares responses, ignoring time locations.
+func sameResponse(a, b response) bool {
+	return string(a.Body) == string(b.Body) && a.Status == b.Status &&
+		reflect.DeepEqual(a.Header, b.Header) && a.Stale == b.Stale &&
+		a.GeneratedETag == b.GeneratedETag &&
+		a.Fetched.Equal(b.Fetched) && a.Expire.Equal(b.Expire)
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, resp := range []response{
+		codecTestResponse(),
+		{Status: 304, Header: http.Header{}, Stale: true, GeneratedETag: true},
+		{Body: []byte{}, Status: 500, Header: http.Header{"Empty": []string{""}}},
+	} {
+		data := encodeResponseBinary(resp)
+		got, err := decodeResponse(data)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if !sameResponse(resp, got) {
+			t.Errorf("round trip mismatch: status=%d: got status=%d header=%v",
+				resp.Status, got.Status, got.Header)
+		}
+	}
+}
+
+// TestCodecJSONCompat decodes entries cached by previous versions.
+func TestCodecJSONCompat(t *testing.T) {
+	resp := codecTestResponse()
+	data, errJSON := json.Marshal(resp)
+	if errJSON != nil {
+		t.Fatal(errJSON)
+	}
+	got, err := decodeResponse(data)
+	if err != nil {
+		t.Fatalf("decode json: %v", err)
+	}
+	if !sameResponse(resp, got) {
+		t.Errorf("json mismatch: got status=%d header=%v fetched=%v",
+			got.Status, got.Header, got.Fetched)
+	}
+
+	legacy := `{"body":"aGVsbG8=","status":200,"header":{"Content-Type":["text/plain"]}}`
+	got, err = decodeResponse([]byte(legacy))
+	if err != nil {
+		t.Fatalf("decode legacy json: %v", err)
+	}
+	if string(got.Body) != "hello" || !got.Fetched.IsZero() {
+		t.Errorf("legacy json: unexpected response: %+v", got)
+	}
+}
+
+func TestCodecTruncated(t *testing.T) {
+	data := encodeResponseBinary(codecTestResponse())
+	bodyStart := len(data) - len(codecTestResponse().Body)
+	for i := 0; i < bodyStart; i++ {
+		if _, err := decodeResponse(data[:i]); err == nil {
+			t.Errorf("truncated at %d: expected error", i)
+		}
+	}
+	if _, err := decodeResponse([]byte{9}); err == nil || errors.Is(err, errResponseTruncated) {
+		t.Errorf("expected unknown format error, got %v", err)
+	}
+}
+
+func BenchmarkCodecEncodeJSON(b *testing.B) {
+	resp := codecTestResponse()
+	b.ReportAllocs()
+	var size int
+	for b.Loop() {
+		data, _ := json.Marshal(resp)
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "entry-bytes")
+}
+
+func BenchmarkCodecEncodeBinary(b *testing.B) {
+	resp := codecTestResponse()
+	b.ReportAllocs()
+	var size int
+	for b.Loop() {
+		size = len(encodeResponseBinary(resp))
+	}
+	b.ReportMetric(float64(size), "entry-bytes")
+}
+
+func BenchmarkCodecDecodeJSON(b *testing.B) {
+	data, _ := json.Marshal(codecTestResponse())
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := decodeResponse(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCodecDecodeBinary(b *testing.B) {
+	data := encodeResponseBinary(codecTestResponse())
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := decodeResponse(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCodecEntriesPerBudget reports how many entries fit in the default
+// GROUPCACHE_SIZE_BYTES budget with each encoding. Groupcache accounts for
+// both key and value bytes.
+func BenchmarkCodecEntriesPerBudget(b *testing.B) {
+	const budget = 100_000_000
+	const key = "GET /myapp/default"
+	resp := codecTestResponse()
+
+	table := []struct {
+		name   string
+		encode func(response) []byte
+	}{
+		{"json", func(r response) []byte { data, _ := json.Marshal(r); return data }},
+		{"binary", encodeResponseBinary},
+	}
+
+	for _, data := range table {
+		b.Run(data.name, func(b *testing.B) {
+			var size int
+			for b.Loop() {
+				size = len(key) + len(data.encode(resp))
+			}
+			b.ReportMetric(float64(size), "entry-bytes")
+			b.ReportMetric(float64(budget/size), "entries")
+		})
+	}
+}
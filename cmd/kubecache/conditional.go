@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// notModifiedHeaders are the headers a 304 response must carry if they
+// would have been sent in a 200 response: RFC 9110 15.4.5.
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"Etag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+}
+
+// conditionalHeaders are answered by kubecache itself from the cached
+// response, hence they are never part of the cache key.
+var conditionalHeaders = []string{
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Range",
+	"If-Unmodified-Since",
+}
+
+// generateETag creates a strong entity tag from the response body.
+func generateETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified reports whether the client already holds the cached response,
+// according to If-None-Match or, in its absence, If-Modified-Since.
+func notModified(r *http.Request, resp response) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if resp.Status != http.StatusOK {
+		return false
+	}
+
+	if inm := r.Header.Values("If-None-Match"); len(inm) > 0 {
+		return etagMatch(strings.Join(inm, ","), resp.Header.Get("Etag"))
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" {
+		return false
+	}
+	since, errSince := http.ParseTime(ims)
+	if errSince != nil {
+		return false
+	}
+	lastModified, errLast := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if errLast != nil {
+		return false
+	}
+	return !lastModified.After(since)
+}
+
+// etagMatch performs the weak comparison of If-None-Match list against etag.
+func etagMatch(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			break
+		}
+		if list[0] == '*' {
+			return true
+		}
+		tag := list
+		if end := scanETag(list); end > 0 {
+			tag, list = list[:end], list[end:]
+		} else {
+			// malformed entry: skip to next comma
+			tag, list, _ = strings.Cut(list, ",")
+		}
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// scanETag returns the length of the entity tag at the start of s,
+// or zero if s does not start with a well-formed entity tag.
+func scanETag(s string) int {
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s) <= start || s[start] != '"' {
+		return 0
+	}
+	end := strings.IndexByte(s[start+1:], '"')
+	if end < 0 {
+		return 0
+	}
+	return start + 1 + end + 1
+}
+
+// notModifiedResponse turns a cached response into a 304 Not Modified.
+func notModifiedResponse(resp response) response {
+	h := http.Header{}
+	for _, name := range notModifiedHeaders {
+		if v, found := resp.Header[name]; found {
+			h[name] = v
+		}
+	}
+	return response{
+		Status:  http.StatusNotModified,
+		Header:  h,
+		Fetched: resp.Fetched,
+		Expire:  resp.Expire,
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/udhos/boilerplate/envconfig"
@@ -13,15 +14,48 @@ type config struct {
 	backendURL                            string
 	restrictRouteRegexp                   string
 	restrictMethod                        string
+	cacheKeyHeaders                       string
+	cacheDiagnosticHeaders                string
+	cacheVaryMaxRoutes                    int
+	forwardHeaders                        string
+	forwardHeadersDeny                    string
 	backendTimeout                        time.Duration
 	cacheTTL                              time.Duration
 	cacheErrorTTL                         time.Duration
+	cacheHonorCacheControl                bool
+	cacheTTLMin                           time.Duration
+	cacheTTLMax                           time.Duration
+	cacheStaleRetention                   time.Duration
+	cacheStaleSizeBytes                   int64
+	cacheStaleWhileRevalidate             time.Duration
+	cacheStaleIfError                     time.Duration
+	cacheNamespaces                       string
+	cacheNamespacesSyncInterval           time.Duration
+	springMonitorEnable                   bool
+	springMonitorSecret                   string
+	springRouteRegexp                     string
+	springMaxApplications                 int
+	adminEnable                           bool
+	adminAddr                             string
+	adminPeerTimeout                      time.Duration
+	adminToken                            string
 	healthAddr                            string
 	healthPath                            string
+	readinessPath                         string
+	backendProbeURL                       string
+	backendProbeInterval                  time.Duration
+	backendProbeFailures                  int
+	shutdownDrainDelay                    time.Duration
+	shutdownServerTimeout                 time.Duration
+	shutdownFetchTimeout                  time.Duration
+	shutdownPeerTimeout                   time.Duration
 	metricsAddr                           string
 	metricsPath                           string
 	metricsNamespace                      string
 	metricsBucketsLatencyHTTP             []float64
+	metricsRouteTemplates                 string
+	metricsRouteSpring                    bool
+	metricsRouteOverflow                  string
 	emfSendLogs                           bool
 	emfEnable                             bool
 	prometheusEnable                      bool
@@ -29,8 +63,11 @@ type config struct {
 	dogstatsdExportInterval               time.Duration
 	dogstatsdDebug                        bool
 	dogstatsdClientTTL                    time.Duration
+	cacheImplementation                   string
+	cacheEncoding                         string
 	groupcacheVersion                     int
 	groupcachePort                        string
+	groupcacheName                        string
 	groupcacheSizeBytes                   int64
 	groupcacheDisablePurgeExpired         bool
 	groupcacheExpiredKeysEvictionInterval time.Duration
@@ -39,6 +76,13 @@ type config struct {
 	kubegroupLabelSelector                string
 	kubegroupForceNamespaceDefault        bool
 	compute                               string
+	staticPeers                           string
+	groupcacheSelf                        string
+	dnsDiscoveryName                      string
+	dnsDiscoverySRV                       bool
+	dnsDiscoveryInterval                  time.Duration
+	peersFile                             string
+	peersFileInterval                     time.Duration
 	forceSingleTask                       bool
 	ecsTaskDiscoveryService               string // ecs service self discovery
 }
@@ -59,6 +103,112 @@ func newConfig(roleSessionName string) config {
 		restrictRouteRegexp: env.String("RESTRICT_ROUTE_REGEXP", `["^/develop", "^/homolog", "^/prod", "/develop/?$", "/homolog/?$", "/prod/?$"]`),
 		restrictMethod:      env.String("RESTRICT_METHOD", `["GET", "HEAD"]`),
 		//
+		// request headers included in the cache key (and forwarded to the backend).
+		// headers named in the backend Vary response header are added automatically,
+		// tracking at most CACHE_VARY_MAX_ROUTES routes. FORWARD_HEADERS_DENY applies.
+		//
+		cacheKeyHeaders:    env.String("CACHE_KEY_HEADERS", `[]`),
+		cacheVaryMaxRoutes: env.Int("CACHE_VARY_MAX_ROUTES", 10000),
+		//
+		// diagnostic response headers: X-Cache (HIT, MISS, BYPASS, STALE), Age (seconds
+		// since the backend response), X-Cache-Owner (peer owning the key) and X-Cache-TTL
+		// (seconds until expiration). X-Cache-Owner discloses peer addresses.
+		//
+		cacheDiagnosticHeaders: env.String("CACHE_DIAGNOSTIC_HEADERS", `[]`),
+		//
+		// client request headers forwarded to the backend by cached requests. forwarded
+		// headers are part of the cache key. requests that bypass the cache forward all
+		// headers. FORWARD_HEADERS_DENY applies to both. hop-by-hop headers are never forwarded.
+		//
+		forwardHeaders:     env.String("FORWARD_HEADERS", `[]`),
+		forwardHeadersDeny: env.String("FORWARD_HEADERS_DENY", `[]`),
+		//
+		// honor backend Cache-Control and Expires headers, clamping the TTL
+		// between CACHE_TTL_MIN and CACHE_TTL_MAX (zero max means no bound).
+		//
+		cacheHonorCacheControl: env.Bool("CACHE_HONOR_CACHE_CONTROL", false),
+		cacheTTLMin:            env.Duration("CACHE_TTL_MIN", 0),
+		cacheTTLMax:            env.Duration("CACHE_TTL_MAX", 24*time.Hour),
+		//
+		// retain expired entries for CACHE_STALE_RETENTION in order to revalidate
+		// them against the backend with If-None-Match/If-Modified-Since.
+		// zero retention disables revalidation.
+		//
+		cacheStaleRetention: env.Duration("CACHE_STALE_RETENTION", 0),
+		cacheStaleSizeBytes: env.Int64("CACHE_STALE_SIZE_BYTES", 50_000_000),
+		//
+		// within CACHE_STALE_WHILE_REVALIDATE after expiration, serve the stale
+		// response immediately and refresh it in background.
+		// zero disables stale-while-revalidate.
+		//
+		cacheStaleWhileRevalidate: env.Duration("CACHE_STALE_WHILE_REVALIDATE", 0),
+		//
+		// when the backend fails, serve the last good response up to
+		// CACHE_STALE_IF_ERROR after its expiration.
+		// zero disables stale-if-error.
+		//
+		cacheStaleIfError: env.Duration("CACHE_STALE_IF_ERROR", 0),
+		//
+		// namespaces group routes purged together: JSON object mapping names
+		// to route regexps, like '{"prod": "^/prod", "myapp": "^/prod/myapp"}'.
+		// POST /cache/namespaces/purge?namespace=prod on the admin api purges
+		// every route in the namespace across the cluster. peers sync generations
+		// at startup, before ready, and every CACHE_NAMESPACES_SYNC_INTERVAL.
+		// generations live only in memory: a full cluster restart resets them,
+		// along with the caches.
+		//
+		cacheNamespaces:             env.String("CACHE_NAMESPACES", `{}`),
+		cacheNamespacesSyncInterval: env.Duration("CACHE_NAMESPACES_SYNC_INTERVAL", 30*time.Second),
+		//
+		// POST /monitor on the admin api accepts Spring Cloud Config server push
+		// notifications (GitHub, GitLab, Bitbucket webhooks), purging the entries
+		// for the applications affected by the changed files. only cached routes
+		// matching SPRING_ROUTE_REGEXP (empty list means any) are taken for
+		// config-server requests. at most SPRING_MAX_APPLICATIONS applications
+		// are tracked. requires ADMIN_ENABLE. git webhooks cannot send the
+		// ADMIN_TOKEN bearer token: set SPRING_MONITOR_SECRET to the webhook
+		// secret, verified from X-Hub-Signature-256 (GitHub) or X-Gitlab-Token
+		// (GitLab).
+		//
+		springMonitorEnable:   env.Bool("SPRING_MONITOR_ENABLE", false),
+		springMonitorSecret:   env.String("SPRING_MONITOR_SECRET", ""),
+		springRouteRegexp:     env.String("SPRING_ROUTE_REGEXP", `[]`),
+		springMaxApplications: env.Int("SPRING_MAX_APPLICATIONS", 10000),
+		//
+		// admin api: POST /cache/purge removes a key from the whole cluster.
+		// peers are reached at their own address, on the port at the same offset
+		// from their groupcache port as ADMIN_ADDR from ours: the ADMIN_ADDR port
+		// when every pod uses the same ports. if ADMIN_TOKEN is set, requests must
+		// send it as "Authorization: Bearer <token>"; otherwise restrict ADMIN_ADDR
+		// to a trusted network.
+		//
+		adminEnable:      env.Bool("ADMIN_ENABLE", false),
+		adminAddr:        env.String("ADMIN_ADDR", ":8889"),
+		adminPeerTimeout: env.Duration("ADMIN_PEER_TIMEOUT", 10*time.Second),
+		adminToken:       env.String("ADMIN_TOKEN", ""),
+		//
+		// readiness fails until the groupcache server is listening and discovery
+		// has delivered the initial peer set. if BACKEND_PROBE_URL is set, readiness
+		// also fails after BACKEND_PROBE_FAILURES consecutive probe failures,
+		// unless CACHE_STALE_IF_ERROR is set: a backend outage fails the probe on
+		// every pod, which would then stop serving the stale entries.
+		//
+		readinessPath:        env.String("READINESS_PATH", "/ready"),
+		backendProbeURL:      env.String("BACKEND_PROBE_URL", ""), // resolved against BACKEND_URL: "/actuator/health"
+		backendProbeInterval: env.Duration("BACKEND_PROBE_INTERVAL", 10*time.Second),
+		backendProbeFailures: env.Int("BACKEND_PROBE_FAILURES", 3),
+		//
+		// shutdown drain: fail readiness and wait SHUTDOWN_DRAIN_DELAY for the load
+		// balancers to notice, stop accepting requests waiting SHUTDOWN_SERVER_TIMEOUT
+		// for in-flight ones, wait SHUTDOWN_FETCH_TIMEOUT for in-flight backend fetches,
+		// then leave the peer ring waiting SHUTDOWN_PEER_TIMEOUT for peer requests.
+		// the chart sets terminationGracePeriodSeconds to cover the sum.
+		//
+		shutdownDrainDelay:    env.Duration("SHUTDOWN_DRAIN_DELAY", 5*time.Second),
+		shutdownServerTimeout: env.Duration("SHUTDOWN_SERVER_TIMEOUT", 5*time.Second),
+		shutdownFetchTimeout:  env.Duration("SHUTDOWN_FETCH_TIMEOUT", 10*time.Second),
+		shutdownPeerTimeout:   env.Duration("SHUTDOWN_PEER_TIMEOUT", 5*time.Second),
+		//
 		cacheTTL:         env.Duration("CACHE_TTL", 300*time.Second),
 		cacheErrorTTL:    env.Duration("CACHE_ERROR_TTL", 60*time.Second),
 		backendTimeout:   env.Duration("BACKEND_TIMEOUT", 300*time.Second),
@@ -69,6 +219,16 @@ func newConfig(roleSessionName string) config {
 		metricsNamespace: env.String("METRICS_NAMESPACE", ""),
 		metricsBucketsLatencyHTTP: env.Float64Slice("METRICS_BUCKETS_LATENCY_HTTP",
 			[]float64{0.00001, 0.000025, 0.00005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000}),
+		//
+		// the uri metric label is the first METRICS_ROUTE_TEMPLATES route matching the
+		// request path, then, if METRICS_ROUTE_SPRING is enabled, the Spring Cloud
+		// Config route (/{application}/{profile}), then METRICS_ROUTE_OVERFLOW,
+		// keeping label cardinality bounded.
+		//
+		metricsRouteTemplates: env.String("METRICS_ROUTE_TEMPLATES", `[]`), // '[{"regexp": "^/api/users/[0-9]+$", "route": "/api/users/{id}"}]'
+		metricsRouteSpring:    env.Bool("METRICS_ROUTE_SPRING", false),
+		metricsRouteOverflow:  env.String("METRICS_ROUTE_OVERFLOW", "UNKNOWN"),
+		//
 		emfSendLogs:                           env.Bool("EMF_SEND_LOGS", false),
 		emfEnable:                             env.Bool("EMF_ENABLE", false),
 		prometheusEnable:                      env.Bool("PROMETHEUS_ENABLE", true),
@@ -76,8 +236,11 @@ func newConfig(roleSessionName string) config {
 		dogstatsdExportInterval:               env.Duration("DOGSTATSD_EXPORT_INTERVAL", 30*time.Second),
 		dogstatsdDebug:                        env.Bool("DOGSTATSD_DEBUG", false),
 		dogstatsdClientTTL:                    env.Duration("DOGSTATSD_CLIENT_TTL", time.Minute),
+		cacheImplementation:                   env.String("CACHE_IMPLEMENTATION", "groupcache"), // "groupcache", "local"
+		cacheEncoding:                         env.String("CACHE_ENCODING", "json"),             // "json", "binary": switch to "binary" once no peer runs a version without binary encoding
 		groupcacheVersion:                     env.Int("GROUPCACHE_VERSION", 2),
 		groupcachePort:                        env.String("GROUPCACHE_PORT", ":5000"),
+		groupcacheName:                        env.String("GROUPCACHE_NAME", ""), // empty: "path" for v2, "files" for v3
 		groupcacheSizeBytes:                   env.Int64("GROUPCACHE_SIZE_BYTES", 100_000_000),
 		groupcacheDisablePurgeExpired:         env.Bool("GROUPCACHE_DISABLE_PURGE_EXPIRED", false),
 		groupcacheExpiredKeysEvictionInterval: env.Duration("GROUPCACHE_EXPIRED_KEYS_EVICTION_INTERVAL", 30*time.Minute),
@@ -85,8 +248,24 @@ func newConfig(roleSessionName string) config {
 		kubegroupDebug:                        env.Bool("KUBEGROUP_DEBUG", true),
 		kubegroupLabelSelector:                env.String("KUBEGROUP_LABEL_SELECTOR", "app=kubecache"),
 		kubegroupForceNamespaceDefault:        env.Bool("KUBEGROUP_FORCE_NAMESPACE_DEFAULT", false),
-		compute:                               env.String("COMPUTE", "kubernetes"), // "ecs", "kubernetes"
+		compute:                               env.String("COMPUTE", "kubernetes"),  // "ecs", "kubernetes", "standalone", "static", "dns", "file"
+		staticPeers:                           env.String("STATIC_PEERS", `[]`),     // COMPUTE=static: '["10.0.0.1:5000", "10.0.0.2:5000"]'
+		groupcacheSelf:                        env.String("GROUPCACHE_SELF", ""),    // host:port announced to peers, defaults to pod IP + GROUPCACHE_PORT
+		dnsDiscoveryName:                      env.String("DNS_DISCOVERY_NAME", ""), // COMPUTE=dns: headless service name
+		dnsDiscoverySRV:                       env.Bool("DNS_DISCOVERY_SRV", false),
+		dnsDiscoveryInterval:                  env.Duration("DNS_DISCOVERY_INTERVAL", 10*time.Second),
+		peersFile:                             env.String("PEERS_FILE", ""), // COMPUTE=file: JSON list or one peer per line
+		peersFileInterval:                     env.Duration("PEERS_FILE_INTERVAL", 5*time.Second),
 		forceSingleTask:                       env.Bool("FORCE_SINGLE_TASK", false),
 		ecsTaskDiscoveryService:               env.String("ECS_TASK_DISCOVERY_SERVICE", "kubecache"), // ecs service self discovery
 	}
 }
+
+// validate rejects settings that cannot work together.
+func (cfg config) validate() error {
+	if cfg.readinessPath == cfg.healthPath {
+		return fmt.Errorf("READINESS_PATH='%s' must differ from HEALTH_PATH: both are served by the health server",
+			cfg.readinessPath)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Diagnostic response headers, selected by CACHE_DIAGNOSTIC_HEADERS.
+// Names are in canonical form, as parsed by parseHeaderList.
+const (
+	headerXCache     = "X-Cache"
+	headerAge        = "Age"
+	headerCacheOwner = "X-Cache-Owner"
+	headerCacheTTL   = "X-Cache-Ttl"
+	xCacheHit        = "HIT"
+	xCacheMiss       = "MISS"
+	xCacheBypass     = "BYPASS"
+	xCacheStale      = "STALE"
+)
+
+// xCache maps the cache result into the X-Cache header value.
+func xCache(result string, stale bool) string {
+	switch {
+	case result == cacheResultBypass:
+		return xCacheBypass
+	case stale:
+		return xCacheStale
+	case result == cacheResultLocalHit, result == cacheResultHotHit, result == cacheResultPeerHit:
+		return xCacheHit
+	}
+	return xCacheMiss
+}
+
+// age returns the seconds since the backend produced the response, adding
+// the Age reported by the backend itself, when behind another cache.
+// Entries cached before the fetch time was recorded have unknown age.
+func age(resp response, now time.Time) (int, bool) {
+	if resp.Fetched.IsZero() {
+		return 0, false
+	}
+	a := int(now.Sub(resp.Fetched) / time.Second)
+	if upstream, errAge := strconv.Atoi(resp.Header.Get(headerAge)); errAge == nil && upstream > 0 {
+		a += upstream
+	}
+	return max(a, 0), true
+}
+
+// setDiagnosticHeaders adds the diagnostic headers enabled in
+// CACHE_DIAGNOSTIC_HEADERS. Key is empty for requests bypassing the cache.
+func (app *application) setDiagnosticHeaders(h http.Header, result, key string, resp response) {
+	if len(app.diagnosticHeaders) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	if slices.Contains(app.diagnosticHeaders, headerXCache) {
+		h.Set(headerXCache, xCache(result, resp.Stale))
+	}
+
+	if key == "" {
+		return // bypass: the backend response is not stored
+	}
+
+	if slices.Contains(app.diagnosticHeaders, headerAge) {
+		if a, known := age(resp, now); known {
+			h.Set(headerAge, strconv.Itoa(a))
+		}
+	}
+
+	if slices.Contains(app.diagnosticHeaders, headerCacheOwner) {
+		if owner := app.peers.keyOwner(key); owner != "" {
+			h.Set(headerCacheOwner, owner) // empty for the local cache
+		}
+	}
+
+	if slices.Contains(app.diagnosticHeaders, headerCacheTTL) && !resp.Expire.IsZero() {
+		ttl := max(int(resp.Expire.Sub(now)/time.Second), 0)
+		h.Set(headerCacheTTL, strconv.Itoa(ttl))
+	}
+}
+
+// setBypassDiagnosticHeaders replaces the diagnostic headers enabled in
+// CACHE_DIAGNOSTIC_HEADERS in the response to a request bypassing the cache,
+// so that headers from the backend, possibly behind another cache, do not
+// contradict ours.
+func (app *application) setBypassDiagnosticHeaders(h http.Header) {
+	for _, name := range app.diagnosticHeaders {
+		h.Del(name)
+	}
+	app.setDiagnosticHeaders(h, cacheResultBypass, "", response{})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/groupcache/groupcache-go/v3/transport/peer"
+	"github.com/rs/zerolog/log"
+	"github.com/udhos/ecs-task-discovery/groupcachediscovery"
+	"github.com/udhos/kube/kubeclient"
+	"github.com/udhos/kubegroup/kubegroup"
+)
+
+// peerSetter receives peer addresses (host:port) from the discovery modes
+// implemented by kubecache itself, feeding either groupcache2 pool or
+// groupcache3 daemon.
+type peerSetter interface {
+	setAddresses(addrs []string)
+}
+
+// poolSetter and peersSetter are the setters taken by the external discovery
+// libraries: the groupcache2 pool as Pool, the groupcache3 daemon as Peers.
+type poolSetter interface {
+	Set(peers ...string)
+}
+
+type peersSetter interface {
+	SetPeers(ctx context.Context, src []peer.Info) error
+}
+
+func (p *trackedPool) setAddresses(addrs []string) {
+	urls := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		urls = append(urls, "http://"+a)
+	}
+	p.Set(urls...)
+}
+
+func (d *trackedDaemon) setAddresses(addrs []string) {
+	infos := make([]peer.Info, 0, len(addrs))
+	for _, a := range addrs {
+		infos = append(infos, peer.Info{Address: a, IsSelf: a == d.tracker.self})
+	}
+	if err := d.SetPeers(context.Background(), infos); err != nil {
+		log.Error().Msgf("groupcache3 set peers: %v", err)
+	}
+}
+
+// startDiscovery starts the watcher for addresses of peers selected by
+// COMPUTE, delivering them to the setter: the groupcache2 pool or the
+// groupcache3 daemon. The external discovery libraries take the pool as
+// Pool and the daemon as Peers.
+func startDiscovery(app *application, setter peerSetter, self string) (func(), error) {
+	switch app.cfg.compute {
+	case "standalone", "static":
+		//
+		// compute: no discovery
+		//
+		return startStaticDiscovery(app, setter, self), nil
+	case "dns":
+		//
+		// compute: dns
+		//
+		return startDNSDiscovery(app, setter, self), nil
+	case "file":
+		//
+		// compute: peers file
+		//
+		return startFileDiscovery(app, setter, self), nil
+	case "ecs":
+		//
+		// compute: amazon ecs
+		//
+		clientEcs := ecs.NewFromConfig(getAwsConfig())
+		discOptions := groupcachediscovery.Options{
+			Client:         clientEcs,
+			GroupCachePort: app.cfg.groupcachePort,
+			ServiceName:    app.cfg.ecsTaskDiscoveryService, // self
+			// Pool, Peers: see below
+			// ForceSingleTask: see below
+			// MetricsRegisterer: see below
+			MetricsNamespace: app.cfg.metricsNamespace,
+			DogstatsdClient:  app.dogstatsdClient,
+		}
+		if pool, ok := setter.(poolSetter); ok {
+			discOptions.Pool = pool
+		}
+		if peers, ok := setter.(peersSetter); ok {
+			discOptions.Peers = peers
+		}
+		if app.cfg.prometheusEnable {
+			discOptions.MetricsRegisterer = app.registry
+		}
+		if app.cfg.forceSingleTask {
+			myAddr, errAddr := groupcachediscovery.FindMyAddr()
+			if errAddr != nil {
+				return nil, fmt.Errorf("groupcache my address: %w", errAddr)
+			}
+			discOptions.ForceSingleTask = myAddr
+		}
+		disc, errDisc := groupcachediscovery.New(discOptions)
+		if errDisc != nil {
+			return nil, fmt.Errorf("groupcache discovery error: %w", errDisc)
+		}
+		return disc.Stop, nil
+	}
+
+	//
+	// compute: kubernetes
+	//
+	clientsetOpt := kubeclient.Options{DebugLog: app.cfg.kubegroupDebug}
+	clientset, errClientset := kubeclient.New(clientsetOpt)
+	if errClientset != nil {
+		return nil, fmt.Errorf("kubeclient: %w", errClientset)
+	}
+	options := kubegroup.Options{
+		Client:                clientset,
+		LabelSelector:         app.cfg.kubegroupLabelSelector,
+		GroupCachePort:        app.cfg.groupcachePort,
+		MetricsNamespace:      app.cfg.kubegroupMetricsNamespace,
+		Debug:                 app.cfg.kubegroupDebug,
+		ForceNamespaceDefault: app.cfg.kubegroupForceNamespaceDefault,
+		DogstatsdClient:       app.dogstatsdClient,
+		//Pool, Peers:         see below
+		//MetricsRegisterer:   see below
+	}
+	if pool, ok := setter.(poolSetter); ok {
+		options.Pool = pool
+	}
+	if peers, ok := setter.(peersSetter); ok {
+		options.Peers = peers
+	}
+	if app.cfg.prometheusEnable {
+		options.MetricsRegisterer = app.registry
+	}
+	kg, errKg := kubegroup.UpdatePeers(options)
+	if errKg != nil {
+		return nil, fmt.Errorf("kubegroup error: %w", errKg)
+	}
+	return kg.Close, nil
+}
+
+// startStaticDiscovery sets the peers once: only self for COMPUTE=standalone,
+// or STATIC_PEERS plus self for COMPUTE=static.
+func startStaticDiscovery(app *application, setter peerSetter, self string) func() {
+	addrs := []string{self}
+
+	if app.cfg.compute == "static" {
+		var list []string
+		if errList := json.Unmarshal([]byte(app.cfg.staticPeers), &list); errList != nil {
+			log.Fatal().Msgf("static peers: '%s': %v", app.cfg.staticPeers, errList)
+		}
+		addrs = peerAddresses(list, app.cfg.groupcachePort, self)
+	}
+
+	log.Info().Msgf("%s discovery: peers: %v", app.cfg.compute, addrs)
+
+	setter.setAddresses(addrs)
+
+	return func() {}
+}
+
+// peerAddresses normalizes peers given as URL (http://host:port), address
+// (host:port) or host, using the groupcache port when missing. Self is always
+// included, since the groupcache ring must be the same on every peer.
+func peerAddresses(list []string, groupcachePort, self string) []string {
+	addrs := []string{self}
+	for _, p := range list {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, after, found := strings.Cut(p, "://"); found {
+			p = after
+		}
+		p = strings.TrimSuffix(p, "/")
+		if _, _, errSplit := net.SplitHostPort(p); errSplit != nil {
+			p += groupcachePort
+		}
+		if !slices.Contains(addrs, p) {
+			addrs = append(addrs, p)
+		}
+	}
+	slices.Sort(addrs)
+	return addrs
+}
+
+// poll calls fn immediately and then every interval, until the returned
+// function is called.
+func poll(interval time.Duration, fn func(ctx context.Context)) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		fn(ctx)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn(ctx)
+			}
+		}
+	}()
+
+	return cancel
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"github.com/udhos/dogstatsdclient/dogstatsdclient"
+)
+
+// dnsDiscovery periodically resolves a DNS name into peer addresses: A/AAAA
+// records of a headless service, using GROUPCACHE_PORT, or SRV records.
+// Unlike kubegroup, it needs no RBAC permission to list pods.
+type dnsDiscovery struct {
+	name      string
+	srv       bool
+	port      string
+	self      string
+	setter    peerSetter
+	lookupIP  func(ctx context.Context, host string) ([]net.IP, error)
+	lookupSRV func(ctx context.Context, name string) ([]*net.SRV, error)
+	metrics   *dnsDiscoveryMetrics
+	dogstatsd *dogstatsdclient.Client
+	last      []string
+}
+
+type dnsDiscoveryMetrics struct {
+	peers   prometheus.Gauge
+	changes prometheus.Counter
+}
+
+func newDNSDiscoveryMetrics(registerer prometheus.Registerer, namespace string) *dnsDiscoveryMetrics {
+	return &dnsDiscoveryMetrics{
+		peers: promauto.With(registerer).NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "dns_discovery_peers",
+			Help:      "Number of peers found by DNS discovery.",
+		}),
+		changes: promauto.With(registerer).NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dns_discovery_peer_changes_total",
+			Help:      "Number of peer set changes found by DNS discovery.",
+		}),
+	}
+}
+
+func startDNSDiscovery(app *application, setter peerSetter, self string) func() {
+	_, port, errPort := net.SplitHostPort(app.cfg.groupcachePort)
+	if errPort != nil {
+		log.Fatal().Msgf("dns discovery: groupcache port: '%s': %v", app.cfg.groupcachePort, errPort)
+	}
+	if app.cfg.dnsDiscoveryName == "" {
+		log.Fatal().Msgf("dns discovery: missing DNS_DISCOVERY_NAME")
+	}
+
+	d := &dnsDiscovery{
+		name:   app.cfg.dnsDiscoveryName,
+		srv:    app.cfg.dnsDiscoverySRV,
+		port:   port,
+		self:   self,
+		setter: setter,
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+		lookupSRV: func(ctx context.Context, name string) ([]*net.SRV, error) {
+			_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+			return addrs, err
+		},
+	}
+	if app.cfg.prometheusEnable {
+		d.metrics = newDNSDiscoveryMetrics(app.registry, app.cfg.metricsNamespace)
+	}
+	d.dogstatsd = app.dogstatsdClient
+
+	return poll(app.cfg.dnsDiscoveryInterval, d.refresh)
+}
+
+// refresh resolves the peers and updates groupcache when they changed.
+// On resolution errors, other than a name without records, the current
+// peers are kept.
+func (d *dnsDiscovery) refresh(ctx context.Context) {
+	addrs, errResolve := d.resolve(ctx)
+	if errResolve != nil {
+		log.Error().Msgf("dns discovery: name='%s' srv=%t: %v", d.name, d.srv, errResolve)
+		return
+	}
+
+	if slices.Equal(addrs, d.last) {
+		return
+	}
+
+	log.Info().Msgf("dns discovery: name='%s' peers: %v", d.name, addrs)
+
+	d.last = addrs
+	d.setter.setAddresses(addrs)
+
+	if d.metrics != nil {
+		d.metrics.peers.Set(float64(len(addrs)))
+		d.metrics.changes.Inc()
+	}
+
+	if d.dogstatsd != nil {
+		if errDd := d.dogstatsd.Gauge("dns_discovery_peers", float64(len(addrs)), nil, 1); errDd != nil {
+			log.Error().Msgf("dogstatsd dns_discovery_peers: %v", errDd)
+		}
+		if errDd := d.dogstatsd.Incr("dns_discovery_peer_changes", nil, 1); errDd != nil {
+			log.Error().Msgf("dogstatsd dns_discovery_peer_changes: %v", errDd)
+		}
+	}
+}
+
+// dnsNotFound reports whether the name has no records. A headless service
+// publishes only ready pods, unless publishNotReadyAddresses is set, so the
+// first pods find no records: they must proceed with self only, otherwise
+// they never become ready.
+func dnsNotFound(err error) bool {
+	var errDNS *net.DNSError
+	return errors.As(err, &errDNS) && errDNS.IsNotFound
+}
+
+// resolve returns the sorted peer addresses, including self. A name without
+// records yields self only.
+func (d *dnsDiscovery) resolve(ctx context.Context) ([]string, error) {
+	var list []string
+
+	if d.srv {
+		records, errSRV := d.lookupSRV(ctx, d.name)
+		if errSRV != nil && !dnsNotFound(errSRV) {
+			return nil, errSRV
+		}
+		for _, r := range records {
+			//
+			// resolve targets, since self is announced by address.
+			// a target that fails to resolve is skipped, so that one
+			// bad record does not hide the other peers.
+			//
+			ips, errIP := d.lookupIP(ctx, r.Target)
+			if errIP != nil {
+				log.Error().Msgf("dns discovery: name='%s' srv target='%s': %v",
+					d.name, r.Target, errIP)
+				continue
+			}
+			for _, ip := range ips {
+				list = append(list, net.JoinHostPort(ip.String(), strconv.Itoa(int(r.Port))))
+			}
+		}
+	} else {
+		ips, errIP := d.lookupIP(ctx, d.name)
+		if errIP != nil && !dnsNotFound(errIP) {
+			return nil, errIP
+		}
+		for _, ip := range ips {
+			list = append(list, net.JoinHostPort(ip.String(), d.port))
+		}
+	}
+
+	return peerAddresses(list, ":"+d.port, d.self), nil
+}
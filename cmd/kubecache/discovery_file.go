@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// fileDiscovery reads the peers from a file managed outside kubecache, like
+// by consul-template, nomad or systemd, reloading it when it changes.
+// The file holds either a JSON list or one peer per line, as URL
+// (http://host:port), address (host:port) or host. Lines starting
+// with # are ignored.
+type fileDiscovery struct {
+	path           string
+	groupcachePort string
+	self           string
+	setter         peerSetter
+	content        []byte
+	last           []string
+}
+
+func startFileDiscovery(app *application, setter peerSetter, self string) func() {
+	if app.cfg.peersFile == "" {
+		log.Fatal().Msgf("file discovery: missing PEERS_FILE")
+	}
+
+	d := &fileDiscovery{
+		path:           app.cfg.peersFile,
+		groupcachePort: app.cfg.groupcachePort,
+		self:           self,
+		setter:         setter,
+	}
+
+	return poll(app.cfg.peersFileInterval, d.refresh)
+}
+
+// refresh reloads the file when its content changed. On errors, the
+// current peers are kept.
+func (d *fileDiscovery) refresh(_ context.Context) {
+	content, errRead := os.ReadFile(d.path)
+	if errRead != nil {
+		log.Error().Msgf("file discovery: %v", errRead)
+		return
+	}
+
+	if d.content != nil && bytes.Equal(content, d.content) {
+		return
+	}
+
+	list, errParse := parsePeersFile(content)
+	if errParse != nil {
+		log.Error().Msgf("file discovery: %s: %v", d.path, errParse)
+		return
+	}
+
+	d.content = content
+
+	addrs := peerAddresses(list, d.groupcachePort, d.self)
+	if slices.Equal(addrs, d.last) {
+		return
+	}
+
+	log.Info().Msgf("file discovery: %s: peers: %v", d.path, addrs)
+
+	d.last = addrs
+	d.setter.setAddresses(addrs)
+}
+
+func parsePeersFile(content []byte) ([]string, error) {
+	trimmed := bytes.TrimSpace(content)
+
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var list []string
+		err := json.Unmarshal(trimmed, &list)
+		return list, err
+	}
+
+	var list []string
+	for _, line := range strings.Split(string(trimmed), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list = append(list, line)
+	}
+	return list, nil
+}
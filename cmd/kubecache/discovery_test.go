@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+type recordingSetter struct {
+	calls [][]string
+}
+
+func (s *recordingSetter) setAddresses(addrs []string) {
+	s.calls = append(s.calls, addrs)
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::3")}
+	var errLookup error
+
+	setter := &recordingSetter{}
+
+	d := &dnsDiscovery{
+		name:   "kubecache-headless",
+		port:   "5000",
+		self:   "10.0.0.1:5000",
+		setter: setter,
+		lookupIP: func(_ context.Context, _ string) ([]net.IP, error) {
+			return ips, errLookup
+		},
+	}
+
+	d.refresh(context.TODO())
+	d.refresh(context.TODO()) // unchanged: not set again
+
+	expected := []string{"10.0.0.1:5000", "10.0.0.2:5000", "[fd00::3]:5000"}
+	if len(setter.calls) != 1 || !slices.Equal(setter.calls[0], expected) {
+		t.Fatalf("expected peers %v once, got %v", expected, setter.calls)
+	}
+
+	errLookup = errors.New("lookup failure")
+	d.refresh(context.TODO()) // error: peers kept
+	if len(setter.calls) != 1 {
+		t.Errorf("peers changed on lookup error: %v", setter.calls)
+	}
+}
+
+func TestDNSDiscoveryNotFound(t *testing.T) {
+	setter := &recordingSetter{}
+
+	d := &dnsDiscovery{
+		name:   "kubecache-headless",
+		port:   "5000",
+		self:   "10.0.0.1:5000",
+		setter: setter,
+		lookupIP: func(_ context.Context, host string) ([]net.IP, error) {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		},
+	}
+
+	// first pod of a headless service: no ready pods published yet
+	d.refresh(context.TODO())
+
+	expected := []string{"10.0.0.1:5000"}
+	if len(setter.calls) != 1 || !slices.Equal(setter.calls[0], expected) {
+		t.Errorf("expected self only on NXDOMAIN, got %v", setter.calls)
+	}
+
+	d.srv = true
+	d.last = nil
+	d.lookupSRV = func(_ context.Context, name string) ([]*net.SRV, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	d.refresh(context.TODO())
+	if len(setter.calls) != 2 || !slices.Equal(setter.calls[1], expected) {
+		t.Errorf("expected self only on SRV NXDOMAIN, got %v", setter.calls)
+	}
+}
+
+func TestDNSDiscoverySRVTargetError(t *testing.T) {
+	d := &dnsDiscovery{
+		name: "_groupcache._tcp.kubecache-headless",
+		srv:  true,
+		port: "5000",
+		self: "10.0.0.1:5000",
+		lookupSRV: func(_ context.Context, _ string) ([]*net.SRV, error) {
+			return []*net.SRV{{Target: "pod-a.", Port: 5000}, {Target: "gone.", Port: 5000}}, nil
+		},
+		lookupIP: func(_ context.Context, host string) ([]net.IP, error) {
+			if host == "pod-a." {
+				return []net.IP{net.ParseIP("10.0.0.2")}, nil
+			}
+			return nil, errors.New("no such host")
+		},
+	}
+
+	addrs, err := d.resolve(context.TODO())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	expected := []string{"10.0.0.1:5000", "10.0.0.2:5000"}
+	if !slices.Equal(addrs, expected) {
+		t.Errorf("expected=%v got=%v", expected, addrs)
+	}
+}
+
+func TestDNSDiscoverySRV(t *testing.T) {
+	d := &dnsDiscovery{
+		name: "_groupcache._tcp.kubecache-headless",
+		srv:  true,
+		port: "5000",
+		self: "10.0.0.1:5000",
+		lookupSRV: func(_ context.Context, _ string) ([]*net.SRV, error) {
+			return []*net.SRV{{Target: "pod-a.", Port: 5000}, {Target: "pod-b.", Port: 5000}}, nil
+		},
+		lookupIP: func(_ context.Context, host string) ([]net.IP, error) {
+			if host == "pod-a." {
+				return []net.IP{net.ParseIP("10.0.0.1")}, nil
+			}
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		},
+	}
+
+	addrs, err := d.resolve(context.TODO())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	expected := []string{"10.0.0.1:5000", "10.0.0.2:5000"}
+	if !slices.Equal(addrs, expected) {
+		t.Errorf("expected=%v got=%v", expected, addrs)
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers")
+
+	setter := &recordingSetter{}
+
+	d := &fileDiscovery{
+		path:           path,
+		groupcachePort: ":5000",
+		self:           "10.0.0.1:5000",
+		setter:         setter,
+	}
+
+	d.refresh(context.TODO()) // missing file: nothing set
+	if len(setter.calls) != 0 {
+		t.Fatalf("peers set from missing file: %v", setter.calls)
+	}
+
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# peers\n10.0.0.2\nhttp://10.0.0.3:5000\n\n")
+	d.refresh(context.TODO())
+	d.refresh(context.TODO()) // unchanged
+
+	expected := []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000"}
+	if len(setter.calls) != 1 || !slices.Equal(setter.calls[0], expected) {
+		t.Fatalf("expected peers %v once, got %v", expected, setter.calls)
+	}
+
+	write(`["10.0.0.2:5000"]`)
+	d.refresh(context.TODO())
+
+	expected = []string{"10.0.0.1:5000", "10.0.0.2:5000"}
+	if len(setter.calls) != 2 || !slices.Equal(setter.calls[1], expected) {
+		t.Fatalf("expected reloaded peers %v, got %v", expected, setter.calls)
+	}
+
+	write(`["bad json`)
+	d.refresh(context.TODO()) // error: peers kept
+	if len(setter.calls) != 2 {
+		t.Errorf("peers changed on parse error: %v", setter.calls)
+	}
+}
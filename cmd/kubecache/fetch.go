@@ -12,7 +12,8 @@ import (
 )
 
 func doFetch(c context.Context, tracer trace.Tracer, httpClient *http.Client,
-	backendURL *url.URL, key string) (response, bool, error) {
+	backendURL *url.URL, key string, conditional http.Header,
+	observe func(backendFetch)) (response, bool, error) {
 
 	const me = "doFetch"
 	ctx, span := tracer.Start(c, me)
@@ -21,19 +22,37 @@ func doFetch(c context.Context, tracer trace.Tracer, httpClient *http.Client,
 	resp := response{Header: http.Header{}}
 	var isErrorStatus bool
 
-	method, u, errKey := parseKey(me, backendURL, key)
+	method, u, reqHeader, errKey := parseKey(me, backendURL, key)
 	if errKey != nil {
 		return resp, isErrorStatus, errKey
 	}
 
+	for k, v := range conditional {
+		reqHeader[k] = v
+	}
+
+	for k, v := range forwarded(ctx) {
+		reqHeader[k] = v
+	}
+
 	begin := time.Now()
 
 	body, respHeaders, status, errFetch := fetch(ctx, httpClient, tracer,
-		method, u)
+		method, u, reqHeader)
 
 	elap := time.Since(begin)
 
-	isErrorStatus = isHTTPError(status)
+	observe(backendFetch{
+		method:  method,
+		path:    backendPath(u),
+		status:  status,
+		bytes:   len(body),
+		elapsed: elap,
+		err:     errFetch,
+	})
+
+	isErrorStatus = isHTTPError(status) &&
+		!(status == http.StatusNotModified && len(conditional) > 0)
 
 	//
 	// log fetch status
@@ -76,11 +95,28 @@ func doFetch(c context.Context, tracer trace.Tracer, httpClient *http.Client,
 		Header: respHeaders,
 	}
 
+	if !isHTTPError(status) && resp.Header.Get("Etag") == "" {
+		//
+		// generate an ETag so that clients can send conditional requests
+		//
+		resp.Header.Set("Etag", generateETag(body))
+		resp.GeneratedETag = true
+	}
+
 	return resp, isErrorStatus, nil
 }
 
+// backendPath extracts the path from the backend request URL.
+func backendPath(u string) string {
+	parsed, errURL := url.Parse(u)
+	if errURL != nil {
+		return ""
+	}
+	return parsed.Path
+}
+
 func fetch(c context.Context, client *http.Client, tracer trace.Tracer,
-	method, uri string) ([]byte, http.Header, int, error) {
+	method, uri string, header http.Header) ([]byte, http.Header, int, error) {
 
 	const me = "fetch"
 	ctx, span := tracer.Start(c, me)
@@ -91,7 +127,14 @@ func fetch(c context.Context, client *http.Client, tracer trace.Tracer,
 		return nil, nil, 500, errReq
 	}
 
-	//req.Header.Add("key", "value")
+	for name, values := range header {
+		for _, v := range values {
+			if v == "" {
+				continue // header was absent from the client request
+			}
+			req.Header.Add(name, v)
+		}
+	}
 
 	resp, errDo := client.Do(req)
 	if errDo != nil {
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// hopByHopHeaders are meaningful only for a single transport-level
+// connection and must not be forwarded by proxies: RFC 9110 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardHeaders returns the client request headers allowed by
+// FORWARD_HEADERS and FORWARD_HEADERS_DENY, without hop-by-hop headers,
+// to be carried in the cache key.
+func (app *application) forwardHeaders(r *http.Request) http.Header {
+	h := http.Header{}
+
+	if len(app.forwardAllow) == 0 {
+		return h
+	}
+
+	hop := slices.Clone(hopByHopHeaders)
+	for _, line := range r.Header.Values("Connection") {
+		for _, name := range strings.Split(line, ",") {
+			hop = append(hop, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+		}
+	}
+
+	for name, values := range r.Header {
+		if slices.Contains(hop, name) || slices.Contains(app.forwardDeny, name) {
+			continue
+		}
+		if !slices.Contains(app.forwardAllow, name) {
+			continue
+		}
+		h[name] = slices.Clone(values)
+	}
+
+	return h
+}
+
+// addForwardedHeaders adds X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host describing the client request.
+func addForwardedHeaders(h http.Header, r *http.Request) {
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		h.Set("X-Forwarded-For", clientIP)
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	h.Set("X-Forwarded-Proto", proto)
+
+	h.Set("X-Forwarded-Host", r.Host)
+}
+
+type forwardedKey struct{}
+
+// withForwarded records the X-Forwarded-* headers describing the client
+// request in the context, to be sent by the backend fetch. They are not part
+// of the cache key: the fetch triggered by one client is shared by all.
+// Loads performed on behalf of a peer carry no X-Forwarded-* headers, since
+// the client request was received by the peer.
+func withForwarded(ctx context.Context, r *http.Request) context.Context {
+	h := http.Header{}
+	addForwardedHeaders(h, r)
+	return context.WithValue(ctx, forwardedKey{}, h)
+}
+
+// forwarded returns the X-Forwarded-* headers recorded in the context.
+func forwarded(ctx context.Context) http.Header {
+	h, _ := ctx.Value(forwardedKey{}).(http.Header)
+	return h
+}
+
+// requestKey builds the groupcache key for the request, carrying the
+// request headers to be sent to the backend, prefixed by the generations
+// of the namespaces matching the request.
+func (app *application) requestKey(r *http.Request, route string) string {
+	header := app.keyHeaders(r, route)
+
+	for name, values := range app.forwardHeaders(r) {
+		if slices.Contains(conditionalHeaders, name) {
+			continue
+		}
+		if _, found := header[name]; !found {
+			header[name] = []string{strings.Join(values, ", ")}
+		}
+	}
+
+	prefix := app.namespaces.prefix(r.URL.RequestURI(), app.springNamespaces(r.URL.Path))
+
+	return prefix + buildKey(r.Method, r.URL.String(), header)
+}
@@ -2,22 +2,19 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/modernprogram/groupcache/v2"
 	"github.com/rs/zerolog/log"
 	"github.com/udhos/boilerplate/awsconfig"
-	"github.com/udhos/ecs-task-discovery/groupcachediscovery"
 	emfexporter "github.com/udhos/groupcache_awsemf/exporter"
 	"github.com/udhos/groupcache_datadog/exporter"
 	"github.com/udhos/groupcache_exporter"
 	"github.com/udhos/groupcache_exporter/groupcache/modernprogram"
-	"github.com/udhos/kube/kubeclient"
 	"github.com/udhos/kubegroup/kubegroup"
 )
 
@@ -29,7 +26,7 @@ func getAwsConfig() aws.Config {
 	return awsCfg.AwsConfig
 }
 
-func startGroupcache(app *application, forceNamespaceDefault bool) func() {
+func startGroupcache(app *application) cache {
 
 	workspace := groupcache.NewWorkspace()
 
@@ -37,13 +34,18 @@ func startGroupcache(app *application, forceNamespaceDefault bool) func() {
 	// create groupcache pool
 	//
 
-	myURL, errURL := kubegroup.FindMyURL(app.cfg.groupcachePort)
-	if errURL != nil {
-		log.Fatal().Msgf("groupcache my URL: %v", errURL)
-	}
+	myURL := "http://" + groupcacheSelfAddr(app)
 	log.Info().Msgf("groupcache my URL: %s", myURL)
 
-	pool := groupcache.NewHTTPPoolOptsWithWorkspace(workspace, myURL, &groupcache.HTTPPoolOptions{})
+	pool := groupcache.NewHTTPPoolOptsWithWorkspace(workspace, myURL, &groupcache.HTTPPoolOptions{
+		Transport: func(context.Context) http.RoundTripper {
+			return &peerRoundTripper{next: http.DefaultTransport}
+		},
+	})
+
+	app.peers = newPeerTracker(myURL)
+	peers := &trackedPool{pool: pool, tracker: app.peers}
+	app.peers.owner = peers.owner
 
 	//
 	// start groupcache server
@@ -53,81 +55,23 @@ func startGroupcache(app *application, forceNamespaceDefault bool) func() {
 
 	go func() {
 		log.Info().Msgf("groupcache server: listening on %s", app.cfg.groupcachePort)
-		err := app.serverGroupCache.ListenAndServe()
+		listener, errListen := net.Listen("tcp", app.cfg.groupcachePort)
+		if errListen != nil {
+			log.Error().Msgf("groupcache server: exited: %v", errListen)
+			return
+		}
+		app.ready.groupcacheListening.Store(true)
+		err := app.serverGroupCache.Serve(listener)
 		log.Error().Msgf("groupcache server: exited: %v", err)
 	}()
 
-	var stopDisc func()
-
-	metricsNamespace := app.cfg.metricsNamespace
-
 	//
 	// start watcher for addresses of peers
 	//
 
-	if app.cfg.compute == "ecs" {
-		//
-		// compute: amazon ecs
-		//
-		clientEcs := ecs.NewFromConfig(getAwsConfig())
-		discOptions := groupcachediscovery.Options{
-			Pool:           pool,
-			Client:         clientEcs,
-			GroupCachePort: app.cfg.groupcachePort,
-			ServiceName:    app.cfg.ecsTaskDiscoveryService, // self
-			// ForceSingleTask: see below
-			// MetricsRegisterer: see below
-			MetricsNamespace: metricsNamespace,
-			DogstatsdClient:  app.dogstatsdClient,
-		}
-		if app.cfg.prometheusEnable {
-			discOptions.MetricsRegisterer = app.registry
-		}
-		if app.cfg.forceSingleTask {
-			myAddr, errAddr := groupcachediscovery.FindMyAddr()
-			if errAddr != nil {
-				log.Fatal().Msgf("startGroupcache: groupcache my address: %v", errAddr)
-			}
-			discOptions.ForceSingleTask = myAddr
-		}
-		disc, errDisc := groupcachediscovery.New(discOptions)
-		if errDisc != nil {
-			log.Fatal().Msgf("startGroupcache: groupcache discovery error: %v", errDisc)
-		}
-		stopDisc = func() {
-			disc.Stop()
-		}
-	} else {
-		//
-		// compute: kubernetes
-		//
-		clientsetOpt := kubeclient.Options{DebugLog: app.cfg.kubegroupDebug}
-		clientset, errClientset := kubeclient.New(clientsetOpt)
-		if errClientset != nil {
-			log.Fatal().Msgf("startGroupcache: kubeclient: %v", errClientset)
-		}
-		options := kubegroup.Options{
-			Client:                clientset,
-			LabelSelector:         app.cfg.kubegroupLabelSelector,
-			Pool:                  pool,
-			GroupCachePort:        app.cfg.groupcachePort,
-			MetricsNamespace:      app.cfg.kubegroupMetricsNamespace,
-			Debug:                 app.cfg.kubegroupDebug,
-			ForceNamespaceDefault: forceNamespaceDefault,
-			DogstatsdClient:       app.dogstatsdClient,
-			//MetricsRegisterer:   see below
-			//MetricsGatherer:     see below
-		}
-		if app.cfg.prometheusEnable {
-			options.MetricsRegisterer = app.registry
-		}
-		kg, errKg := kubegroup.UpdatePeers(options)
-		if errKg != nil {
-			log.Fatal().Msgf("kubegroup error: %v", errKg)
-		}
-		stopDisc = func() {
-			kg.Close()
-		}
+	stopDisc, errDisc := startDiscovery(app, peers, strings.TrimPrefix(myURL, "http://"))
+	if errDisc != nil {
+		log.Fatal().Msgf("startGroupcache: %v", errDisc)
 	}
 
 	//
@@ -135,37 +79,18 @@ func startGroupcache(app *application, forceNamespaceDefault bool) func() {
 	//
 
 	getter := groupcache.GetterFunc(
-		func(c context.Context, key string, dest groupcache.Sink, _ *groupcache.Info) error {
-
-			const me = "groupcache.getter"
-			ctx, span := app.tracer.Start(c, me)
-			defer span.End()
-
-			resp, isErrorStatus, errFetch := doFetch(ctx, app.tracer, app.httpClient, app.backendURL, key)
-			if errFetch != nil {
-				return errFetch
+		func(ctx context.Context, key string, dest groupcache.Sink, _ *groupcache.Info) error {
+			data, expire, errLoad := app.cacheGetter(ctx, key)
+			if errLoad != nil {
+				return errLoad
 			}
-
-			data, errJ := json.Marshal(resp)
-			if errJ != nil {
-				return fmt.Errorf("%s: marshal json response: %v", me, errJ)
-			}
-
-			var ttl time.Duration
-			if isErrorStatus {
-				ttl = app.cfg.cacheErrorTTL
-			} else {
-				ttl = app.cfg.cacheTTL
-			}
-			expire := time.Now().Add(ttl)
-
 			return dest.SetBytes(data, expire)
 		},
 	)
 
 	groupcacheOptions := groupcache.Options{
 		Workspace:                   workspace,
-		Name:                        "path",
+		Name:                        groupName(app.cfg.groupcacheName, "path"),
 		PurgeExpired:                !app.cfg.groupcacheDisablePurgeExpired,
 		ExpiredKeysEvictionInterval: app.cfg.groupcacheExpiredKeysEvictionInterval,
 		CacheBytesLimit:             app.cfg.groupcacheSizeBytes,
@@ -175,10 +100,93 @@ func startGroupcache(app *application, forceNamespaceDefault bool) func() {
 	// https://talks.golang.org/2013/oscon-dl.slide#46
 	//
 	// 64 MB max per-node memory usage
-	app.cache = groupcache.NewGroupWithWorkspace(groupcacheOptions)
+	group := groupcache.NewGroupWithWorkspace(groupcacheOptions)
 
 	listGroups := func() []groupcache_exporter.GroupStatistics { return modernprogram.ListGroups(workspace) }
 
+	closeExporters := startGroupcacheExporters(app, listGroups)
+
+	return &groupcache2Cache{
+		group: group,
+		close: func() {
+			stopDisc()
+			closeExporters()
+		},
+	}
+}
+
+// groupcacheSelfAddr returns the host:port announced to peers: GROUPCACHE_SELF
+// when set, the loopback address for standalone, which has no peers, or the
+// pod address. The groupcache server always listens on GROUPCACHE_PORT.
+func groupcacheSelfAddr(app *application) string {
+	if app.cfg.groupcacheSelf != "" {
+		return app.cfg.groupcacheSelf
+	}
+	if app.cfg.compute == "standalone" {
+		return "127.0.0.1" + app.cfg.groupcachePort
+	}
+	myIP, errAddr := kubegroup.FindMyAddress()
+	if errAddr != nil {
+		log.Fatal().Msgf("groupcache my address: %v", errAddr)
+	}
+	return myIP + app.cfg.groupcachePort
+}
+
+// groupName returns GROUPCACHE_NAME, defaulting to the group name each
+// groupcache version has always used, so that upgrades keep the group.
+func groupName(name, versionDefault string) string {
+	if name == "" {
+		return versionDefault
+	}
+	return name
+}
+
+// groupcache2Cache implements cache with groupcache2.
+type groupcache2Cache struct {
+	group *groupcache.Group
+	close func()
+}
+
+func (c *groupcache2Cache) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := c.group.Get(ctx, key, groupcache.AllocatingByteSliceSink(&data), nil)
+	return data, err
+}
+
+func (c *groupcache2Cache) Remove(ctx context.Context, key string) error {
+	return c.group.Remove(ctx, key)
+}
+
+func (c *groupcache2Cache) Stats() cacheStats {
+	main := c.group.CacheStats(groupcache.MainCache)
+	hot := c.group.CacheStats(groupcache.HotCache)
+	return cacheStats{
+		Gets:       c.group.Stats.Gets.Get(),
+		Hits:       c.group.Stats.CacheHits.Get(),
+		Loads:      c.group.Stats.Loads.Get(),
+		PeerLoads:  c.group.Stats.PeerLoads.Get(),
+		PeerErrors: c.group.Stats.PeerErrors.Get(),
+		LoadErrors: c.group.Stats.LocalLoadErrs.Get(),
+		Bytes:      main.Bytes + hot.Bytes,
+		Items:      main.Items + hot.Items,
+		Evictions:  main.Evictions + hot.Evictions,
+	}
+}
+
+func (c *groupcache2Cache) Close() {
+	c.close()
+}
+
+// emfExportInterval is the interval for exporting metrics in CloudWatch EMF.
+const emfExportInterval = 20 * time.Second
+
+// startGroupcacheExporters exports groupcache statistics to Prometheus,
+// Dogstatsd and AWS CloudWatch EMF, as enabled.
+func startGroupcacheExporters(app *application,
+	listGroups func() []groupcache_exporter.GroupStatistics) func() {
+
+	metricsNamespace := app.cfg.metricsNamespace
+
 	unregister := func() {}
 
 	if app.cfg.prometheusEnable {
@@ -213,7 +221,7 @@ func startGroupcache(app *application, forceNamespaceDefault bool) func() {
 		opt := emfexporter.Options{
 			Application:    "kubecache",
 			ListGroups:     listGroups,
-			ExportInterval: 20 * time.Second,
+			ExportInterval: emfExportInterval,
 		}
 
 		if app.cfg.emfSendLogs {
@@ -234,7 +242,6 @@ func startGroupcache(app *application, forceNamespaceDefault bool) func() {
 	}
 
 	return func() {
-		stopDisc()
 		unregister()
 		closeExporterDogstatsd()
 		closeEmf()
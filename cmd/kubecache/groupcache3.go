@@ -2,20 +2,17 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"time"
+	"net/http"
+	"sync/atomic"
 
-	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/groupcache/groupcache-go/v3"
 	"github.com/groupcache/groupcache-go/v3/transport"
 	"github.com/rs/zerolog/log"
-	"github.com/udhos/ecs-task-discovery/groupcachediscovery"
-	"github.com/udhos/kube/kubeclient"
-	"github.com/udhos/kubegroup/kubegroup"
+	"github.com/udhos/groupcache_exporter"
+	"github.com/udhos/groupcache_exporter/groupcache/groupcache3"
 )
 
-func startGroupcache3(app *application, forceNamespaceDefault bool) func() {
+func startGroupcache3(app *application) cache {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -23,149 +20,139 @@ func startGroupcache3(app *application, forceNamespaceDefault bool) func() {
 	// create groupcache instance
 	//
 
-	myIP, errAddr := kubegroup.FindMyAddress()
-	if errAddr != nil {
-		log.Fatal().Msgf("groupcache my address: %v", errAddr)
+	myAddr := groupcacheSelfAddr(app)
+	log.Info().Msgf("groupcache my address: %s", myAddr)
+
+	cacheFactory := &expiringCacheFactory{
+		purgeExpired:     !app.cfg.groupcacheDisablePurgeExpired,
+		evictionInterval: app.cfg.groupcacheExpiredKeysEvictionInterval,
 	}
-	log.Info().Msgf("groupcache my address: %s", myIP)
 
-	myAddr := myIP + app.cfg.groupcachePort
+	log.Info().Msgf("groupcache server: listening on %s", app.cfg.groupcachePort)
 
-	daemon, errDaemon := groupcache.ListenAndServe(ctx, myAddr, groupcache.Options{})
+	daemon, errDaemon := groupcache.ListenAndServe(ctx, app.cfg.groupcachePort, groupcache.Options{
+		CacheFactory: cacheFactory.newCache,
+		Transport: transport.NewHttpTransport(transport.HttpTransportOptions{
+			Client: &http.Client{Transport: &peerRoundTripper{next: http.DefaultTransport}},
+		}),
+	})
 	if errDaemon != nil {
 		log.Fatal().Msgf("groupcache3 daemon: %v", errDaemon)
 	}
+	app.ready.groupcacheListening.Store(true)
+
+	app.peers = newPeerTracker(myAddr)
+	peers := &trackedDaemon{daemon: daemon, tracker: app.peers}
+	app.peers.owner = peers.owner
 
 	//
 	// start watcher for addresses of peers
 	//
 
-	var stopDisc func()
-
-	if app.cfg.compute == "ecs" {
-		//
-		// compute: amazon ecs
-		//
-		clientEcs := ecs.NewFromConfig(getAwsConfig())
-		discOptions := groupcachediscovery.Options{
-			Peers:           daemon,
-			Client:          clientEcs,
-			GroupCachePort:  app.cfg.groupcachePort,
-			ServiceName:     app.cfg.ecsTaskDiscoveryService, // self
-			DogstatsdClient: app.dogstatsdClient,
-			// ForceSingleTask: see below
-		}
-		if app.cfg.forceSingleTask {
-			myAddr, errAddr := groupcachediscovery.FindMyAddr()
-			if errAddr != nil {
-				log.Fatal().Msgf("startGroupcache3: groupcache my address: %v", errAddr)
-			}
-			discOptions.ForceSingleTask = myAddr
-		}
-		disc, errDisc := groupcachediscovery.New(discOptions)
-		if errDisc != nil {
-			log.Fatal().Msgf("startGroupcache3: groupcache discovery error: %v", errDisc)
-		}
-		stopDisc = func() {
-			disc.Stop()
-			{
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-				if err := daemon.Shutdown(ctx); err != nil {
-					log.Error().Msgf("groupcache3 daemon shutdown error: %v", err)
-				}
-			}
-			cancel()
-		}
-	} else {
-		//
-		// compute: kubernetes
-		//
-		clientsetOpt := kubeclient.Options{DebugLog: app.cfg.kubegroupDebug}
-		clientset, errClientset := kubeclient.New(clientsetOpt)
-		if errClientset != nil {
-			log.Fatal().Msgf("kubeclient: %v", errClientset)
-		}
-		options := kubegroup.Options{
-			Client:                clientset,
-			LabelSelector:         app.cfg.kubegroupLabelSelector,
-			Peers:                 daemon,
-			GroupCachePort:        app.cfg.groupcachePort,
-			MetricsRegisterer:     app.registry,
-			MetricsNamespace:      app.cfg.kubegroupMetricsNamespace,
-			Debug:                 app.cfg.kubegroupDebug,
-			ForceNamespaceDefault: forceNamespaceDefault,
-			DogstatsdClient:       app.dogstatsdClient,
-		}
-		kg, errKg := kubegroup.UpdatePeers(options)
-		if errKg != nil {
-			log.Fatal().Msgf("kubegroup error: %v", errKg)
-		}
-		stopDisc = func() {
-			{
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-				if err := daemon.Shutdown(ctx); err != nil {
-					log.Error().Msgf("groupcache3 daemon shutdown error: %v", err)
-				}
-			}
-			kg.Close()
-			cancel()
+	stopPeers, errDisc := startDiscovery(app, peers, myAddr)
+	if errDisc != nil {
+		log.Fatal().Msgf("startGroupcache3: %v", errDisc)
+	}
+
+	stopDisc := func() {
+		stopPeers()
+		ctx, cancelShutdown := context.WithTimeout(context.Background(), app.cfg.shutdownPeerTimeout)
+		defer cancelShutdown()
+		if err := daemon.Shutdown(ctx); err != nil {
+			log.Error().Msgf("groupcache3 daemon shutdown error: %v", err)
 		}
+		cancel()
 	}
 
 	//
 	// create cache
 	//
 
-	getter := groupcache.GetterFunc(
-		func(c context.Context, key string, dest transport.Sink) error {
-
-			const me = "groupcache.getter"
-			ctx, span := app.tracer.Start(c, me)
-			defer span.End()
-
-			resp, isErrorStatus, errFetch := doFetch(ctx, app.tracer, app.httpClient, app.backendURL, key)
-			if errFetch != nil {
-				return errFetch
-			}
-
-			data, errJ := json.Marshal(resp)
-			if errJ != nil {
-				return fmt.Errorf("%s: marshal json response: %v", me, errJ)
-			}
+	c := &groupcache3Cache{}
 
-			var ttl time.Duration
-			if isErrorStatus {
-				ttl = app.cfg.cacheErrorTTL
-			} else {
-				ttl = app.cfg.cacheTTL
+	getter := groupcache.GetterFunc(
+		func(ctx context.Context, key string, dest transport.Sink) error {
+			c.loads.Add(1)
+			data, expire, errLoad := app.cacheGetter(ctx, key)
+			if errLoad != nil {
+				if !isNotStored(errLoad) {
+					c.loadErrors.Add(1)
+				}
+				return errLoad
 			}
-			expire := time.Now().Add(ttl)
-
 			return dest.SetBytes(data, expire)
 		},
 	)
 
-	cache, errGroup := daemon.NewGroup("files", app.cfg.groupcacheSizeBytes, getter)
+	group, errGroup := daemon.NewGroup(groupName(app.cfg.groupcacheName, "files"),
+		app.cfg.groupcacheSizeBytes, getter)
 	if errGroup != nil {
 		log.Fatal().Msgf("new group error: %v", errGroup)
 	}
 
-	app.cache3 = cache
+	//
+	// expose metrics for groupcache
+	//
+
+	listGroups := func() []groupcache_exporter.GroupStatistics { return groupcache3.ListGroups(daemon) }
+
+	closeExporters := startGroupcacheExporters(app, listGroups)
+
+	c.group = group
+	c.close = func() {
+		stopDisc()
+		closeExporters()
+		cacheFactory.close()
+	}
+
+	return c
+}
+
+// groupcache3Cache implements cache with groupcache3.
+type groupcache3Cache struct {
+	group      transport.Group
+	close      func()
+	gets       atomic.Int64
+	loads      atomic.Int64 // getter calls, including loads requested by peers
+	loadErrors atomic.Int64
+}
+
+func (c *groupcache3Cache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.gets.Add(1)
+	var data []byte
+	err := c.group.Get(ctx, key, transport.AllocatingByteSliceSink(&data))
+	return data, err
+}
+
+func (c *groupcache3Cache) Remove(ctx context.Context, key string) error {
+	return c.group.Remove(ctx, key)
+}
+
+func (c *groupcache3Cache) Stats() cacheStats {
+	var s cacheStats
+
+	s.Gets = c.gets.Load()
+	s.Loads = c.loads.Load()
+	s.LoadErrors = c.loadErrors.Load()
 
 	//
-	// expose prometheus metrics for groupcache
+	// groupcache3 exposes only the cache statistics: hits are counted by
+	// the caches, peer statistics are not available
 	//
+	if cs, ok := c.group.(interface {
+		CacheStats(groupcache.CacheType) groupcache.CacheStats
+	}); ok {
+		main := cs.CacheStats(groupcache.MainCache)
+		hot := cs.CacheStats(groupcache.HotCache)
+		s.Hits = main.Hits + hot.Hits
+		s.Bytes = main.Bytes + hot.Bytes
+		s.Items = main.Items + hot.Items
+		s.Evictions = main.Evictions + hot.Evictions
+	}
 
-	/*
-		g := modernprogram.New(app.cache)
-		labels := map[string]string{}
-		namespace := ""
-		collector := groupcache_exporter.NewExporter(namespace, labels, g)
-		app.registry.MustRegister(collector)
-	*/
-	log.Error().Msgf("XXX TODO FIXME WRITEME groupcache3 expose prometheus metrics")
+	return s
+}
 
-	return stopDisc
+func (c *groupcache3Cache) Close() {
+	c.close()
 }
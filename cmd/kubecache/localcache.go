@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/groupcache/groupcache-go/v3/transport"
+	"github.com/rs/zerolog/log"
+	"github.com/udhos/groupcache_exporter"
+)
+
+// localCache is an in-process cache for a single node: no peers, no
+// discovery and no groupcache server.
+type localCache struct {
+	app            *application
+	store          *expiringCache
+	mu             sync.Mutex
+	calls          map[string]*localCall // loads in flight
+	loads          atomic.Int64
+	loadErrors     atomic.Int64
+	closeExporters func()
+}
+
+// localCall is a load in flight, shared by concurrent gets for the key.
+type localCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newLocalCache(app *application) *localCache {
+	log.Info().Msgf("local cache: size=%d", app.cfg.groupcacheSizeBytes)
+
+	app.peers = newPeerTracker("")
+	app.peers.set(nil)
+	app.ready.groupcacheListening.Store(true) // no groupcache server
+
+	c := &localCache{
+		app: app,
+		store: newExpiringCache(app.cfg.groupcacheSizeBytes,
+			!app.cfg.groupcacheDisablePurgeExpired,
+			app.cfg.groupcacheExpiredKeysEvictionInterval),
+		calls: map[string]*localCall{},
+	}
+
+	//
+	// expose metrics like groupcache
+	//
+
+	name := groupName(app.cfg.groupcacheName, "local")
+	listGroups := func() []groupcache_exporter.GroupStatistics {
+		return []groupcache_exporter.GroupStatistics{&localGroupStatistics{name: name, c: c}}
+	}
+	c.closeExporters = startGroupcacheExporters(app, listGroups)
+
+	return c
+}
+
+func (c *localCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if v, found := c.store.Get(key); found {
+		return v.ByteSlice(), nil
+	}
+
+	c.mu.Lock()
+	if call, found := c.calls[key]; found {
+		c.mu.Unlock()
+		<-call.done
+		return call.data, call.err
+	}
+	call := &localCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	c.loads.Add(1)
+
+	data, expire, err := c.app.cacheGetter(ctx, key)
+	switch {
+	case isNotStored(err):
+	case err != nil:
+		c.loadErrors.Add(1)
+	default:
+		c.store.Add(key, transport.ByteViewWithExpire(data, expire))
+	}
+
+	call.data, call.err = data, err
+	close(call.done)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+
+	return data, err
+}
+
+func (c *localCache) Remove(_ context.Context, key string) error {
+	c.store.Remove(key)
+	return nil
+}
+
+func (c *localCache) Stats() cacheStats {
+	s := c.store.Stats()
+	return cacheStats{
+		Gets:       s.Gets,
+		Hits:       s.Hits,
+		Loads:      c.loads.Load(),
+		LoadErrors: c.loadErrors.Load(),
+		Bytes:      s.Bytes,
+		Items:      s.Items,
+		Evictions:  s.Evictions,
+	}
+}
+
+func (c *localCache) Close() {
+	c.closeExporters()
+	c.store.Close()
+}
+
+// localGroupStatistics adapts the local cache statistics to the groupcache
+// exporters. There are no peers and no hot cache.
+type localGroupStatistics struct {
+	name string
+	c    *localCache
+}
+
+func (s *localGroupStatistics) Name() string                        { return s.name }
+func (s *localGroupStatistics) Gets() int64                         { return s.c.store.Stats().Gets }
+func (s *localGroupStatistics) CacheHits() int64                    { return s.c.store.Stats().Hits }
+func (s *localGroupStatistics) GetFromPeersLatencyLower() float64   { return 0 }
+func (s *localGroupStatistics) PeerLoads() int64                    { return 0 }
+func (s *localGroupStatistics) PeerErrors() int64                   { return 0 }
+func (s *localGroupStatistics) Loads() int64                        { return s.Gets() - s.CacheHits() }
+func (s *localGroupStatistics) LoadsDeduped() int64                 { return s.c.loads.Load() }
+func (s *localGroupStatistics) LocalLoads() int64                   { return s.c.loads.Load() - s.c.loadErrors.Load() }
+func (s *localGroupStatistics) LocalLoadErrs() int64                { return s.c.loadErrors.Load() }
+func (s *localGroupStatistics) ServerRequests() int64               { return 0 }
+func (s *localGroupStatistics) CrosstalkRefusals() int64            { return 0 }
+func (s *localGroupStatistics) MainCacheItems() int64               { return s.c.store.Stats().Items }
+func (s *localGroupStatistics) MainCacheBytes() int64               { return s.c.store.Stats().Bytes }
+func (s *localGroupStatistics) MainCacheGets() int64                { return s.Gets() }
+func (s *localGroupStatistics) MainCacheHits() int64                { return s.CacheHits() }
+func (s *localGroupStatistics) MainCacheEvictions() int64           { return s.c.store.Stats().Evictions }
+func (s *localGroupStatistics) MainCacheEvictionsNonExpired() int64 { return 0 }
+func (s *localGroupStatistics) HotCacheItems() int64                { return 0 }
+func (s *localGroupStatistics) HotCacheBytes() int64                { return 0 }
+func (s *localGroupStatistics) HotCacheGets() int64                 { return 0 }
+func (s *localGroupStatistics) HotCacheHits() int64                 { return 0 }
+func (s *localGroupStatistics) HotCacheEvictions() int64            { return 0 }
+func (s *localGroupStatistics) HotCacheEvictionsNonExpired() int64  { return 0 }
@@ -94,6 +94,8 @@ func main() {
 	{
 		log.Info().Msgf("registering health route: %s %s",
 			app.cfg.healthAddr, app.cfg.healthPath)
+		log.Info().Msgf("registering readiness route: %s %s",
+			app.cfg.healthAddr, app.cfg.readinessPath)
 
 		mux := http.NewServeMux()
 		app.serverHealth = &http.Server{Addr: app.cfg.healthAddr, Handler: mux}
@@ -101,6 +103,7 @@ func main() {
 			_ /*r*/ *http.Request) {
 			fmt.Fprintln(w, "health ok")
 		})
+		mux.HandleFunc(app.cfg.readinessPath, app.handleReadiness)
 
 		go func() {
 			log.Info().Msgf("health server: listening on %s %s",
@@ -130,6 +133,23 @@ func main() {
 		}()
 	}
 
+	//
+	// start admin server
+	//
+
+	if app.cfg.adminEnable {
+		log.Info().Msgf("registering admin route: %s %s",
+			app.cfg.adminAddr, adminPurgePath)
+
+		app.serverAdmin = &http.Server{Addr: app.cfg.adminAddr, Handler: app.adminHandler()}
+
+		go func() {
+			log.Info().Msgf("admin server: listening on %s", app.cfg.adminAddr)
+			err := app.serverAdmin.ListenAndServe()
+			log.Error().Msgf("admin server: exited: %v", err)
+		}()
+	}
+
 	gracefulShutdown(app)
 }
 
@@ -10,7 +10,11 @@ import (
 )
 
 type prometheusMetrics struct {
-	latencySpring *prometheus.HistogramVec
+	latencySpring  *prometheus.HistogramVec
+	cacheResults   *prometheus.CounterVec
+	backendLatency *prometheus.HistogramVec
+	backendSize    *prometheus.HistogramVec
+	backendErrors  *prometheus.CounterVec
 }
 
 func outcomeFrom(status int, isError bool) string {
@@ -31,8 +35,27 @@ func (m *prometheusMetrics) recordLatency(method, status, uri, outcome string, e
 	m.latencySpring.WithLabelValues(method, status, uri, outcome).Observe(sec)
 }
 
+func (m *prometheusMetrics) recordCacheResult(method, uri, result string) {
+	m.cacheResults.WithLabelValues(method, uri, result).Inc()
+}
+
+// recordBackend records a backend request. errType is empty on success.
+func (m *prometheusMetrics) recordBackend(method, status, uri, backend, errType string,
+	bytes int, elapsed time.Duration) {
+	sec := float64(elapsed) / float64(time.Second)
+	m.backendLatency.WithLabelValues(method, status, uri, backend).Observe(sec)
+	if errType != "" {
+		m.backendErrors.WithLabelValues(method, uri, backend, errType).Inc()
+		return
+	}
+	m.backendSize.WithLabelValues(method, status, uri, backend).Observe(float64(bytes))
+}
+
 var (
-	dimensionsSpring = []string{"method", "status", "uri", "outcome"}
+	dimensionsSpring       = []string{"method", "status", "uri", "outcome"}
+	dimensionsCacheResult  = []string{"method", "uri", "result"}
+	dimensionsBackend      = []string{"method", "status", "uri", "backend"}
+	dimensionsBackendError = []string{"method", "uri", "backend", "error"}
 )
 
 func newMetrics(registerer prometheus.Registerer, namespace string,
@@ -50,6 +73,46 @@ func newMetrics(registerer prometheus.Registerer, namespace string,
 			},
 			dimensionsSpring,
 		),
+
+		cacheResults: promauto.With(registerer).NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "cache_results_total",
+				Help:      "Requests by cache result: local_hit, hot_hit, peer_hit, backend_load, bypass, error.",
+			},
+			dimensionsCacheResult,
+		),
+
+		backendLatency: newHistogramVec(
+			registerer,
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "backend_requests_seconds",
+				Help:      "Backend request duration in seconds.",
+				Buckets:   latencyBucketsHTTP,
+			},
+			dimensionsBackend,
+		),
+
+		backendSize: newHistogramVec(
+			registerer,
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "backend_response_bytes",
+				Help:      "Backend response body size in bytes.",
+				Buckets:   prometheus.ExponentialBuckets(256, 4, 8), // 256B to 4MB
+			},
+			dimensionsBackend,
+		),
+
+		backendErrors: promauto.With(registerer).NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "backend_errors_total",
+				Help:      "Backend requests failed without response: timeout, dns, connection_refused, connection_reset, canceled, other.",
+			},
+			dimensionsBackendError,
+		),
 	}
 }
 
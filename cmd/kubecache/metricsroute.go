@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// routeTemplate names the request paths matching Regexp.
+type routeTemplate struct {
+	Regexp string `json:"regexp"`
+	Route  string `json:"route"`
+	re     *regexp.Regexp
+}
+
+// routeTemplates maps request paths into a bounded set of route names for
+// the uri metric label, since raw paths would explode label cardinality.
+type routeTemplates struct {
+	templates []routeTemplate // first match wins
+	spring    bool
+	overflow  string
+}
+
+// newRouteTemplates creates the templates from a JSON list of objects
+// {"regexp": "^/api/users/[0-9]+$", "route": "/api/users/{id}"}.
+func newRouteTemplates(list string, spring bool, overflow string) (*routeTemplates, error) {
+	var templates []routeTemplate
+	if errList := json.Unmarshal([]byte(list), &templates); errList != nil {
+		return nil, fmt.Errorf("route templates: '%s': %v", list, errList)
+	}
+
+	for i, t := range templates {
+		re, errRe := regexp.Compile(t.Regexp)
+		if errRe != nil {
+			return nil, fmt.Errorf("route templates: compile: route='%s' expr='%s': %v",
+				t.Route, t.Regexp, errRe)
+		}
+		templates[i].re = re
+	}
+
+	return &routeTemplates{templates: templates, spring: spring, overflow: overflow}, nil
+}
+
+// route returns the route name for the request path: the first matching
+// template, then the Spring Cloud Config route, then the overflow name.
+func (rt *routeTemplates) route(p string) string {
+	for _, t := range rt.templates {
+		if t.re.MatchString(p) {
+			return t.Route
+		}
+	}
+	if rt.spring {
+		if r, found := springRouteTemplate(p); found {
+			return r
+		}
+	}
+	return rt.overflow
+}
+
+// springRouteTemplate returns the Spring Cloud Config route template for the
+// path, like /{application}/{profile}/{label}.
+func springRouteTemplate(p string) (string, bool) {
+	if _, ok := parseSpringRoute(p); !ok {
+		return "", false
+	}
+
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	ext := path.Ext(segments[len(segments)-1])
+
+	if len(segments) <= 2 && slices.Contains(springConfigExtensions, ext) {
+		if len(segments) == 2 {
+			return "/{label}/{application}-{profile}" + ext, true
+		}
+		return "/{application}-{profile}" + ext, true
+	}
+
+	switch len(segments) {
+	case 2:
+		return "/{application}/{profile}", true
+	case 3:
+		return "/{application}/{profile}/{label}", true
+	}
+	return "/{application}/{profile}/{label}/{path}", true
+}
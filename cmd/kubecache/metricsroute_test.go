@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+type routeTemplateTestCase struct {
+	path          string
+	expectedRoute string
+}
+
+var routeTemplateTestTable = []routeTemplateTestCase{
+	{"/api/users/42", "/api/users/{id}"},
+	{"/api/users/42/orders", "UNKNOWN"}, // too many segments for a spring route
+	{"/myapp/default", "/{application}/{profile}"},
+	{"/app1,app2/prod/develop", "/{application}/{profile}/{label}"},
+	{"/myapp/default/develop/logback.xml", "/{application}/{profile}/{label}/{path}"},
+	{"/myapp-prod.yml", "/{application}-{profile}.yml"},
+	{"/develop/myapp-default.json", "/{label}/{application}-{profile}.json"},
+	{"/myapp", "UNKNOWN"},
+	{"/", "UNKNOWN"},
+}
+
+func TestRouteTemplates(t *testing.T) {
+	routes, errRoutes := newRouteTemplates(`[{"regexp": "^/api/users/[0-9]+$", "route": "/api/users/{id}"}]`,
+		true, "UNKNOWN")
+	if errRoutes != nil {
+		t.Fatal(errRoutes)
+	}
+	for _, data := range routeTemplateTestTable {
+		if r := routes.route(data.path); r != data.expectedRoute {
+			t.Errorf("%s: expected route=%s got=%s", data.path, data.expectedRoute, r)
+		}
+	}
+
+	noSpring, _ := newRouteTemplates(`[]`, false, "other")
+	if r := noSpring.route("/myapp/default"); r != "other" {
+		t.Errorf("spring disabled: expected overflow route, got=%s", r)
+	}
+
+	if _, err := newRouteTemplates(`[{"regexp": "(", "route": "bad"}]`, true, "UNKNOWN"); err == nil {
+		t.Errorf("expected error for invalid regexp")
+	}
+}
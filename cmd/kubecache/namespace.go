@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// namespace groups the cached routes that are purged together.
+type namespace struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// namespaceStore keeps the generation number of each namespace.
+//
+// Generations live only in memory. A starting pod learns them from its peers,
+// hence they survive as long as one pod keeps running. After a full cluster
+// restart every generation is back to zero, which is harmless, since every
+// cache restarts empty as well.
+//
+// Groupcache cannot enumerate keys, hence entries cannot be purged by prefix.
+// Instead, the generation of every namespace matching a route is embedded in
+// the route key, so bumping the generation makes every old entry of the
+// namespace unreachable. Old entries are then evicted by groupcache as usual.
+type namespaceStore struct {
+	namespaces  []namespace // sorted by name
+	maxDerived  int         // bound for namespaces not configured
+	mu          sync.Mutex
+	generations map[string]uint64
+}
+
+// newNamespaceStore creates the store from a JSON object mapping namespace
+// names to route regular expressions. Namespaces derived from requests, like
+// spring applications, are tracked up to maxDerived.
+func newNamespaceStore(list string, maxDerived int) (*namespaceStore, error) {
+	var m map[string]string
+	if errList := json.Unmarshal([]byte(list), &m); errList != nil {
+		return nil, fmt.Errorf("namespaces: '%s': %v", list, errList)
+	}
+
+	s := &namespaceStore{generations: map[string]uint64{}, maxDerived: maxDerived}
+
+	for _, name := range slices.Sorted(maps.Keys(m)) {
+		if name == springNamespaceAll || strings.HasPrefix(name, springNamespaceAll+":") {
+			return nil, fmt.Errorf("namespaces: name='%s' is reserved for spring applications", name)
+		}
+		re, errRe := regexp.Compile(m[name])
+		if errRe != nil {
+			return nil, fmt.Errorf("namespaces: compile: name='%s' expr='%s': %v",
+				name, m[name], errRe)
+		}
+		s.namespaces = append(s.namespaces, namespace{name: name, re: re})
+	}
+
+	return s, nil
+}
+
+func (s *namespaceStore) enabled() bool {
+	return len(s.namespaces) > 0
+}
+
+func (s *namespaceStore) exists(name string) bool {
+	return slices.ContainsFunc(s.namespaces, func(ns namespace) bool { return ns.name == name })
+}
+
+// prefix returns the key prefix "name@generation,... " for the namespaces
+// matching the uri, plus the namespaces derived from the request, like
+// spring applications. Namespaces never purged are omitted, so keys remain
+// unchanged until the first purge.
+func (s *namespaceStore) prefix(uri string, derived []string) string {
+	names := slices.Clone(derived)
+	for _, ns := range s.namespaces {
+		if ns.re.MatchString(uri) {
+			names = append(names, ns.name)
+		}
+	}
+	slices.Sort(names)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []string
+	for _, name := range names {
+		gen := s.generations[name]
+		if gen == 0 {
+			continue
+		}
+		list = append(list, fmt.Sprintf("%s@%d", url.QueryEscape(name), gen))
+	}
+	if len(list) == 0 {
+		return ""
+	}
+	return strings.Join(list, ",") + " "
+}
+
+// admit reports whether the generation for name can be recorded: configured
+// namespaces always are, derived ones up to maxDerived. Called with the lock held.
+func (s *namespaceStore) admit(name string) bool {
+	if _, found := s.generations[name]; found || s.exists(name) {
+		return true
+	}
+	derived := 0
+	for n := range s.generations {
+		if !s.exists(n) {
+			derived++
+		}
+	}
+	return derived < s.maxDerived
+}
+
+// bump increments the namespace generation, returning the new generation.
+// It returns false if the store is full.
+func (s *namespaceStore) bump(name string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.admit(name) {
+		return 0, false
+	}
+	s.generations[name]++
+	return s.generations[name], true
+}
+
+// merge adopts the generations received from peers, keeping the highest ones.
+func (s *namespaceStore) merge(generations map[string]uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, gen := range generations {
+		if !s.admit(name) {
+			log.Error().Msgf("namespace store full: maxDerived=%d: not tracking namespace='%s'",
+				s.maxDerived, name)
+			continue
+		}
+		if gen > s.generations[name] {
+			s.generations[name] = gen
+		}
+	}
+}
+
+// snapshot returns a copy of the generations.
+func (s *namespaceStore) snapshot() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.generations)
+}
+
+// validNamespace reports whether the name is either configured or a
+// namespace ServeHTTP may derive from requests, like spring applications.
+// Names received from peers are checked, so peers cannot grow the store
+// with arbitrary names.
+func (app *application) validNamespace(name string) bool {
+	if app.namespaces.exists(name) {
+		return true
+	}
+	return app.cfg.springMonitorEnable && validSpringNamespace(name)
+}
+
+// startNamespaceSync periodically pulls the generations from peers,
+// catching up with purges missed while starting or while unreachable.
+// The first sync runs as soon as discovery delivers the peers, and the pod
+// is not ready until then, so it never serves entries purged before it
+// started. Unreachable peers do not hold readiness back.
+func (app *application) startNamespaceSync() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		if !app.peers.waitDiscovered(ctx) {
+			return
+		}
+		app.syncNamespaces(ctx)
+		app.ready.namespacesSynced.Store(true)
+
+		ticker := time.NewTicker(app.cfg.cacheNamespacesSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				app.syncNamespaces(ctx)
+			}
+		}
+	}()
+
+	return cancel
+}
+
+func (app *application) syncNamespaces(c context.Context) {
+
+	const me = "app.syncNamespaces"
+	ctx, span := app.tracer.Start(c, me)
+	defer span.End()
+
+	peerURLs, errURLs := app.peerAdminURLs()
+	if errURLs != nil {
+		log.Error().Msgf("%s: %v", me, errURLs)
+		return
+	}
+
+	for _, peerURL := range peerURLs {
+		body, errCall := app.adminCall(ctx, "GET", peerURL+adminNamespacesPath)
+		if errCall != nil {
+			log.Error().Msgf("%s: peer %s: %v", me, peerURL, errCall)
+			continue
+		}
+		var generations map[string]uint64
+		if errJ := json.Unmarshal(body, &generations); errJ != nil {
+			log.Error().Msgf("%s: peer %s: json: %v", me, peerURL, errJ)
+			continue
+		}
+		maps.DeleteFunc(generations, func(name string, _ uint64) bool {
+			return !app.validNamespace(name)
+		})
+		app.namespaces.merge(generations)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/groupcache/groupcache-go/v3"
+	"github.com/groupcache/groupcache-go/v3/transport/peer"
+	groupcache2 "github.com/modernprogram/groupcache/v2"
+)
+
+// peerTracker records the peer list delivered by discovery to groupcache,
+// since neither groupcache nor discovery expose it.
+type peerTracker struct {
+	mu      sync.Mutex
+	self    string
+	peers   []string
+	changed time.Time
+	isSet   bool                    // discovery delivered the initial peer set
+	setCh   chan struct{}           // closed when isSet
+	owner   func(key string) string // nil when there are no peers
+}
+
+func newPeerTracker(self string) *peerTracker {
+	return &peerTracker{self: self, setCh: make(chan struct{})}
+}
+
+func (t *peerTracker) set(peers []string) {
+	peers = slices.Clone(peers)
+	slices.Sort(peers)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.isSet {
+		t.isSet = true
+		close(t.setCh)
+	}
+
+	if slices.Equal(peers, t.peers) {
+		return
+	}
+	t.peers = peers
+	t.changed = time.Now()
+}
+
+// list returns the current peers and when they last changed.
+func (t *peerTracker) list() ([]string, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.peers), t.changed
+}
+
+// discovered reports whether discovery has delivered the initial peer set.
+func (t *peerTracker) discovered() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.isSet
+}
+
+// waitDiscovered blocks until discovery has delivered the initial peer set,
+// returning false if the context is done first.
+func (t *peerTracker) waitDiscovered(ctx context.Context) bool {
+	select {
+	case <-t.setCh:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// keyOwner returns the peer owning the key under the consistent hash.
+func (t *peerTracker) keyOwner(key string) string {
+	if t.owner == nil {
+		return t.self
+	}
+	return t.owner(key)
+}
+
+// owns reports whether self owns the key under the consistent hash.
+func (t *peerTracker) owns(key string) bool {
+	return t.keyOwner(key) == t.self
+}
+
+// others returns the peers other than self.
+func (t *peerTracker) others() []string {
+	peers, _ := t.list()
+	var others []string
+	for _, p := range peers {
+		if p != t.self {
+			others = append(others, p)
+		}
+	}
+	return others
+}
+
+// peerHostPort extracts host and port from either a groupcache2 peer URL
+// (http://10.0.0.1:5000) or a groupcache3 peer address (10.0.0.1:5000).
+func peerHostPort(p string) (string, string, error) {
+	if strings.Contains(p, "://") {
+		u, err := url.Parse(p)
+		if err != nil {
+			return "", "", err
+		}
+		p = u.Host
+	}
+	return net.SplitHostPort(p)
+}
+
+// trackedPool delivers peer updates to groupcache2 pool and to the tracker.
+type trackedPool struct {
+	pool    *groupcache2.HTTPPool
+	tracker *peerTracker
+}
+
+func (p *trackedPool) Set(peers ...string) {
+	p.tracker.set(peers)
+	p.pool.Set(peers...)
+}
+
+func (p *trackedPool) owner(key string) string {
+	getter, remote := p.pool.PickPeer(key)
+	if !remote {
+		return p.tracker.self
+	}
+	if g, ok := getter.(interface{ GetURL() string }); ok {
+		return g.GetURL()
+	}
+	return "unknown"
+}
+
+// trackedDaemon delivers peer updates to groupcache3 daemon and to the tracker.
+type trackedDaemon struct {
+	daemon  *groupcache.Daemon
+	tracker *peerTracker
+}
+
+func (d *trackedDaemon) SetPeers(ctx context.Context, src []peer.Info) error {
+	peers := make([]string, 0, len(src))
+	for _, p := range src {
+		peers = append(peers, p.Address)
+	}
+	d.tracker.set(peers)
+	return d.daemon.SetPeers(ctx, src)
+}
+
+func (d *trackedDaemon) owner(key string) string {
+	client, remote := d.daemon.GetInstance().PickPeer(key)
+	if !remote || client == nil {
+		return d.tracker.self
+	}
+	return client.PeerInfo().Address
+}
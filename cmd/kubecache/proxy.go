@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// newProxy creates the reverse proxy used for requests that bypass the cache.
+// The proxy forwards the client request headers, except those denied by
+// FORWARD_HEADERS_DENY. The reverse proxy itself removes hop-by-hop headers.
+// Diagnostic headers in the backend response are replaced by ours.
+func (app *application) newProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			//
+			// keep request path and query, like the cached path does in parseKey
+			//
+			pr.Out.URL.Scheme = app.backendURL.Scheme
+			pr.Out.URL.Host = app.backendURL.Host
+			pr.Out.Host = ""
+
+			for _, name := range app.forwardDeny {
+				pr.Out.Header.Del(name)
+			}
+
+			//
+			// the reverse proxy removes the inbound X-Forwarded-For: restore it,
+			// so SetXForwarded appends the client to the chain, like the cached
+			// path does in addForwardedHeaders
+			//
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			pr.SetXForwarded()
+		},
+		Transport: app.httpClient.Transport,
+		ModifyResponse: func(resp *http.Response) error {
+			app.setBypassDiagnosticHeaders(resp.Header)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			if rec, ok := w.(*statusRecorder); ok {
+				rec.err = err
+			}
+			app.setBypassDiagnosticHeaders(w.Header())
+			// logged by ServeHTTP, but not sent: it may disclose backend addresses
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+}
+
+// proxy streams the request, including its body, to the backend and streams
+// the backend response back to the client. The returned response carries only
+// the status, since the body has already been sent.
+func (app *application) proxy(c context.Context, w http.ResponseWriter, r *http.Request) (response, error) {
+
+	const me = "app.proxy"
+	ctx, span := app.tracer.Start(c, me)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, app.cfg.backendTimeout)
+	defer cancel()
+
+	rec := &statusRecorder{ResponseWriter: w, status: 200}
+
+	begin := time.Now()
+
+	app.reverseProxy.ServeHTTP(rec, r.WithContext(ctx))
+
+	app.recordBackendFetch(backendFetch{
+		method:  r.Method,
+		path:    r.URL.Path,
+		status:  rec.status,
+		bytes:   rec.bytes,
+		elapsed: time.Since(begin),
+		err:     rec.err,
+	})
+
+	return response{Status: rec.status}, rec.err
+}
+
+// statusRecorder records the status and body size written by the reverse proxy.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+	err    error
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(data []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(data)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying
+// writer, so the proxy is able to flush streamed responses.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
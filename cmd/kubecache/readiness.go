@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// readiness tracks the conditions for the pod to receive traffic.
+// Liveness is served at HEALTH_PATH and always succeeds while the
+// process runs.
+type readiness struct {
+	groupcacheListening atomic.Bool
+	namespacesSynced    atomic.Bool // first namespace sync done, or not needed
+	draining            atomic.Bool
+	backendFailures     atomic.Int64 // consecutive backend probe failures
+}
+
+// notReady returns the reasons the application is not ready, if any.
+func (app *application) notReady() []string {
+	var reasons []string
+
+	if app.ready.draining.Load() {
+		reasons = append(reasons, "draining")
+	}
+
+	if !app.ready.groupcacheListening.Load() {
+		reasons = append(reasons, "groupcache server not listening")
+	}
+
+	if app.peers == nil || !app.peers.discovered() {
+		reasons = append(reasons, "peer discovery pending")
+	}
+
+	if !app.ready.namespacesSynced.Load() {
+		reasons = append(reasons, "namespace sync pending")
+	}
+
+	//
+	// with CACHE_STALE_IF_ERROR, pods serve stale entries while the backend
+	// is down, so a failing backend must not take every pod out of service.
+	//
+	if app.cfg.backendProbeURL != "" && app.cfg.cacheStaleIfError == 0 {
+		if f := app.ready.backendFailures.Load(); f >= int64(app.cfg.backendProbeFailures) {
+			reasons = append(reasons, fmt.Sprintf("backend probe failed %d times", f))
+		}
+	}
+
+	return reasons
+}
+
+func (app *application) handleReadiness(w http.ResponseWriter, _ *http.Request) {
+	reasons := app.notReady()
+	if len(reasons) > 0 {
+		http.Error(w, "not ready: "+strings.Join(reasons, ", "), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// startBackendProbe periodically requests BACKEND_PROBE_URL, which is
+// resolved against BACKEND_URL, so a path is enough.
+func (app *application) startBackendProbe() func() {
+	if app.cfg.backendProbeURL == "" {
+		return func() {}
+	}
+
+	u, errURL := url.Parse(app.cfg.backendProbeURL)
+	if errURL != nil {
+		log.Fatal().Msgf("backend probe URL: %v", errURL)
+	}
+	probeURL := app.backendURL.ResolveReference(u).String()
+
+	log.Info().Msgf("backend probe: %s every %v, not ready after %d failures",
+		probeURL, app.cfg.backendProbeInterval, app.cfg.backendProbeFailures)
+
+	if app.cfg.cacheStaleIfError > 0 {
+		log.Warn().Msgf("backend probe: CACHE_STALE_IF_ERROR=%v is set: probe failures are logged but do not fail readiness",
+			app.cfg.cacheStaleIfError)
+	}
+
+	return poll(app.cfg.backendProbeInterval, func(ctx context.Context) {
+		if errProbe := app.probeBackend(ctx, probeURL); errProbe != nil {
+			f := app.ready.backendFailures.Add(1)
+			log.Error().Msgf("backend probe: %s: failures=%d: %v", probeURL, f, errProbe)
+			return
+		}
+		app.ready.backendFailures.Store(0)
+	})
+}
+
+// probeBackend fails on errors and on 5xx status.
+func (app *application) probeBackend(c context.Context, probeURL string) error {
+	ctx, cancel := context.WithTimeout(c, app.cfg.backendProbeInterval)
+	defer cancel()
+
+	req, errReq := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if errReq != nil {
+		return errReq
+	}
+
+	resp, errDo := app.httpClient.Do(req)
+	if errDo != nil {
+		return errDo
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
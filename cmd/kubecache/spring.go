@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// springNamespaceAll is bumped when a change affects every application,
+// like application.yml.
+const springNamespaceAll = "spring"
+
+// springConfigExtensions are the formats served by config-server.
+var springConfigExtensions = []string{".yml", ".yaml", ".properties", ".json"}
+
+// springApplicationName restricts the application names accepted in
+// namespaces received from peers.
+var springApplicationName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// springRoute describes a Spring Cloud Config server request path.
+type springRoute struct {
+	applications []string
+	profile      string
+	label        string
+}
+
+// parseSpringRoute parses the config-server request paths:
+//
+//	/{application}/{profile}[/{label}[/{path}]]
+//	/{application}-{profile}.{ext}
+//	/{label}/{application}-{profile}.{ext}
+//
+// Application may be a comma-separated list. The {path} of a plain text
+// resource must name a file with extension, so that deeper paths of other
+// services are not taken for config-server requests. Shorter paths are
+// ambiguous: SPRING_ROUTE_REGEXP selects the config-server routes.
+func parseSpringRoute(p string) (springRoute, bool) {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	if slices.Contains(segments, "") {
+		return springRoute{}, false
+	}
+
+	last := segments[len(segments)-1]
+
+	if len(segments) <= 2 && slices.Contains(springConfigExtensions, path.Ext(last)) {
+		stem := strings.TrimSuffix(last, path.Ext(last))
+		app, profile, found := cutLast(stem, "-")
+		if !found || app == "" || profile == "" {
+			return springRoute{}, false
+		}
+		r := springRoute{applications: strings.Split(app, ","), profile: profile}
+		if len(segments) == 2 {
+			r.label = segments[0]
+		}
+		return r, true
+	}
+
+	if len(segments) < 2 {
+		return springRoute{}, false
+	}
+
+	if len(segments) > 3 && path.Ext(last) == "" {
+		return springRoute{}, false // {path} is a file
+	}
+
+	r := springRoute{
+		applications: strings.Split(segments[0], ","),
+		profile:      segments[1],
+	}
+	if len(segments) > 2 {
+		r.label = segments[2]
+	}
+	return r, true
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// springNamespaces returns the namespaces for a config-server request path:
+// one for all applications and one for each application in the path.
+func (app *application) springNamespaces(p string) []string {
+	if !app.cfg.springMonitorEnable || !mustCacheRoute(p, app.springRouteRegexp) {
+		return nil
+	}
+	r, ok := parseSpringRoute(p)
+	if !ok {
+		return nil
+	}
+	names := []string{springNamespaceAll}
+	for _, a := range r.applications {
+		names = append(names, springNamespace(a))
+	}
+	return names
+}
+
+func springNamespace(application string) string {
+	return springNamespaceAll + ":" + application
+}
+
+// validSpringNamespace reports whether the name is a spring namespace.
+func validSpringNamespace(name string) bool {
+	if name == springNamespaceAll {
+		return true
+	}
+	application, found := strings.CutPrefix(name, springNamespaceAll+":")
+	return found && springApplicationName.MatchString(application)
+}
+
+// springApplications maps a changed file in the config repository to the
+// affected applications, like config-server PropertyPathEndpoint does:
+// "foo-bar-dev.yml" affects "foo-bar-dev", "foo-bar" and "foo", while
+// "application.yml" and "application-dev.yml" affect every application,
+// reported as "*".
+func springApplications(file string) []string {
+	stem := path.Base(file)
+	stem = strings.TrimSuffix(stem, path.Ext(stem))
+
+	if stem == "application" || strings.HasPrefix(stem, "application-") || stem == "*" {
+		return []string{"*"}
+	}
+
+	var apps []string
+	for stem != "" {
+		apps = append(apps, stem)
+		var found bool
+		stem, _, found = cutLast(stem, "-")
+		if !found {
+			break
+		}
+	}
+	return apps
+}
+
+// springPushEvent is the subset of GitHub, GitLab, Gitea and Gitee push
+// webhook payloads listing the changed files.
+type springPushEvent struct {
+	Commits []struct {
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Removed  []string `json:"removed"`
+	} `json:"commits"`
+}
+
+// springChangedFiles extracts the changed files from a config-server
+// /monitor notification.
+func springChangedFiles(r *http.Request, body []byte) ([]string, error) {
+	if r.Header.Get("X-Event-Key") == "repo:push" {
+		//
+		// Bitbucket payloads do not list files
+		//
+		return []string{"application.yml"}, nil
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, errForm := url.ParseQuery(string(body))
+		if errForm != nil {
+			return nil, errForm
+		}
+		return form["path"], nil
+	}
+
+	var event springPushEvent
+	if errJ := json.Unmarshal(body, &event); errJ != nil {
+		return nil, errJ
+	}
+	var files []string
+	for _, c := range event.Commits {
+		files = append(files, c.Added...)
+		files = append(files, c.Modified...)
+		files = append(files, c.Removed...)
+	}
+	return files, nil
+}
+
+// validWebhookSecret checks the git webhook secret, since webhooks cannot
+// send a bearer token: the GitHub body signature X-Hub-Signature-256 or the
+// GitLab X-Gitlab-Token.
+func validWebhookSecret(r *http.Request, body []byte, secret string) bool {
+	if sig, found := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256="); found {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return hmac.Equal([]byte(sig), []byte(hex.EncodeToString(mac.Sum(nil))))
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	return false
+}
+
+// handleSpringMonitor is compatible with the Spring Cloud Config server
+// /monitor push notification: it purges across the cluster every cached
+// entry for the applications affected by the changed files. With
+// SPRING_MONITOR_SECRET, the notification must carry the webhook secret or
+// the ADMIN_TOKEN bearer token.
+func (app *application) handleSpringMonitor(w http.ResponseWriter, r *http.Request) {
+
+	const me = "app.handleSpringMonitor"
+	ctx, span := app.tracer.Start(r.Context(), me)
+	defer span.End()
+
+	body, errBody := io.ReadAll(r.Body)
+	if errBody != nil {
+		http.Error(w, errBody.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if app.cfg.springMonitorSecret != "" && !validToken(r, app.cfg.adminToken) &&
+		!validWebhookSecret(r, body, app.cfg.springMonitorSecret) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	files, errFiles := springChangedFiles(r, body)
+	if errFiles != nil {
+		http.Error(w, "bad notification: "+errFiles.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var apps []string
+	for _, f := range files {
+		for _, a := range springApplications(f) {
+			if !slices.Contains(apps, a) {
+				apps = append(apps, a)
+			}
+		}
+	}
+
+	status := http.StatusOK
+
+	for _, a := range apps {
+		name := springNamespace(a)
+		if a == "*" {
+			name = springNamespaceAll
+		}
+		result := app.bumpNamespace(ctx, name)
+		if len(result.Errors) > 0 {
+			status = http.StatusInternalServerError
+			log.Error().Msgf("%s: namespace='%s' generation=%d errors: %v",
+				me, name, result.Generation, result.Errors)
+		}
+	}
+
+	log.Info().Msgf("%s: files=%v applications=%v", me, files, apps)
+
+	if apps == nil {
+		apps = []string{}
+	}
+
+	writeJSON(me, w, status, apps)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+type springRouteTestCase struct {
+	path         string
+	expectedOk   bool
+	applications []string
+	profile      string
+	label        string
+}
+
+var springRouteTestTable = []springRouteTestCase{
+	{"/myapp/default", true, []string{"myapp"}, "default", ""},
+	{"/myapp/default/develop", true, []string{"myapp"}, "default", "develop"},
+	{"/myapp/default/develop/logback.xml", true, []string{"myapp"}, "default", "develop"},
+	{"/api/users/42/orders", false, nil, "", ""},
+	{"/app1,app2/prod", true, []string{"app1", "app2"}, "prod", ""},
+	{"/myapp-prod.yml", true, []string{"myapp"}, "prod", ""},
+	{"/my-app-prod.properties", true, []string{"my-app"}, "prod", ""},
+	{"/develop/myapp-default.json", true, []string{"myapp"}, "default", "develop"},
+	{"/myapp", false, nil, "", ""},
+	{"/myapp.yml", false, nil, "", ""},
+	{"/", false, nil, "", ""},
+	{"//default", false, nil, "", ""},
+}
+
+func TestParseSpringRoute(t *testing.T) {
+	for _, data := range springRouteTestTable {
+		r, ok := parseSpringRoute(data.path)
+		if ok != data.expectedOk {
+			t.Errorf("%s: expected ok=%t got ok=%t", data.path, data.expectedOk, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !slices.Equal(r.applications, data.applications) {
+			t.Errorf("%s: applications: expected=%v got=%v", data.path, data.applications, r.applications)
+		}
+		if r.profile != data.profile {
+			t.Errorf("%s: profile: expected=%s got=%s", data.path, data.profile, r.profile)
+		}
+		if r.label != data.label {
+			t.Errorf("%s: label: expected=%s got=%s", data.path, data.label, r.label)
+		}
+	}
+}
+
+func TestValidSpringNamespace(t *testing.T) {
+	table := []struct {
+		name     string
+		expected bool
+	}{
+		{"spring", true},
+		{"spring:my-app_1.0", true},
+		{"spring:", false},
+		{"spring:a b", false},
+		{"other", false},
+	}
+	for _, data := range table {
+		if got := validSpringNamespace(data.name); got != data.expected {
+			t.Errorf("%s: expected=%t got=%t", data.name, data.expected, got)
+		}
+	}
+
+	if _, err := newNamespaceStore(`{"spring": "^/"}`, 10); err == nil {
+		t.Errorf("expected error for reserved namespace name")
+	}
+}
+
+func TestNamespaceStoreBound(t *testing.T) {
+	s, errStore := newNamespaceStore(`{"prod": "^/prod"}`, 2)
+	if errStore != nil {
+		t.Fatal(errStore)
+	}
+	s.merge(map[string]uint64{"spring:a": 1, "spring:b": 1, "spring:c": 1})
+	if n := len(s.snapshot()); n != 2 {
+		t.Errorf("expected 2 derived namespaces, got %d", n)
+	}
+	if _, ok := s.bump("prod"); !ok {
+		t.Errorf("configured namespace refused by full store")
+	}
+	if _, ok := s.bump("spring:d"); ok {
+		t.Errorf("derived namespace accepted by full store")
+	}
+}
+
+func TestSpringApplications(t *testing.T) {
+	table := []struct {
+		file     string
+		expected []string
+	}{
+		{"foo-bar-dev.yml", []string{"foo-bar-dev", "foo-bar", "foo"}},
+		{"config/foo.properties", []string{"foo"}},
+		{"application.yml", []string{"*"}},
+		{"application-dev.yml", []string{"*"}},
+	}
+	for _, data := range table {
+		apps := springApplications(data.file)
+		if !slices.Equal(apps, data.expected) {
+			t.Errorf("%s: expected=%v got=%v", data.file, data.expected, apps)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// staleStore retains backend responses beyond their groupcache expiration,
+// so that expired entries can be revalidated against the backend with
+// conditional requests instead of downloaded again.
+//
+// The getter runs on the key owner, hence each peer only retains the
+// entries it owns.
+type staleStore struct {
+	mu        sync.Mutex
+	retention time.Duration
+	maxBytes  int64
+	bytes     int64
+	lru       *list.List // front is most recently used
+	entries   map[string]*list.Element
+	purges    uint64 // incremented by every purge
+}
+
+type staleEntry struct {
+	key    string
+	resp   response
+	expire time.Time // groupcache expiration
+	size   int64
+}
+
+// newStaleStore creates a stale store. Zero retention disables the store.
+func newStaleStore(retention time.Duration, maxBytes int64) *staleStore {
+	return &staleStore{
+		retention: retention,
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		entries:   map[string]*list.Element{},
+	}
+}
+
+func (s *staleStore) enabled() bool {
+	return s.retention > 0
+}
+
+// get returns the retained entry for key, if it has not outlived the retention.
+func (s *staleStore) get(key string) (staleEntry, bool) {
+	if !s.enabled() {
+		return staleEntry{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, found := s.entries[key]
+	if !found {
+		return staleEntry{}, false
+	}
+	e := elem.Value.(*staleEntry)
+	if time.Now().After(e.expire.Add(s.retention)) {
+		s.removeElement(elem)
+		return staleEntry{}, false
+	}
+	s.lru.MoveToFront(elem)
+	return *e, true
+}
+
+// generation returns the purge generation, to be handed back to put.
+func (s *staleStore) generation() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.purges
+}
+
+// put retains the response for key, evicting least recently used entries
+// to stay within maxBytes. The response is discarded if any purge happened
+// since the generation was taken before fetching it, otherwise a fetch
+// finishing after a purge would bring the purged content back.
+func (s *staleStore) put(key string, resp response, expire time.Time, generation uint64) {
+	if !s.enabled() {
+		return
+	}
+
+	e := &staleEntry{
+		key:    key,
+		resp:   resp,
+		expire: expire,
+		size:   entrySize(key, resp),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if generation != s.purges {
+		return
+	}
+
+	if elem, found := s.entries[key]; found {
+		s.removeElement(elem)
+	}
+
+	if e.size > s.maxBytes {
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(e)
+	s.bytes += e.size
+
+	for s.bytes > s.maxBytes {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+// remove drops the entry for key.
+func (s *staleStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, found := s.entries[key]; found {
+		s.removeElement(elem)
+	}
+}
+
+// purge drops the entry for key, discarding the fetches in flight.
+func (s *staleStore) purge(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purges++
+	if elem, found := s.entries[key]; found {
+		s.removeElement(elem)
+	}
+}
+
+func (s *staleStore) removeElement(elem *list.Element) {
+	e := s.lru.Remove(elem).(*staleEntry)
+	delete(s.entries, e.key)
+	s.bytes -= e.size
+}
+
+func entrySize(key string, resp response) int64 {
+	size := len(key) + len(resp.Body)
+	for k, v := range resp.Header {
+		size += len(k)
+		for _, vv := range v {
+			size += len(vv)
+		}
+	}
+	return int64(size)
+}
+
+// validators returns the conditional request headers for revalidating
+// the stale response. ETags generated by kubecache are not sent, since
+// the backend does not know them.
+func validators(resp response) http.Header {
+	h := http.Header{}
+	if etag := resp.Header.Get("Etag"); etag != "" && !resp.GeneratedETag {
+		h.Set("If-None-Match", etag)
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		h.Set("If-Modified-Since", lastModified)
+	}
+	return h
+}
+
+// refreshStale updates the stale response with the headers received in
+// a 304 Not Modified: RFC 9111 4.3.4.
+func refreshStale(stale response, notModified http.Header) response {
+	h := stale.Header.Clone()
+	for k, v := range notModified {
+		switch k {
+		case "Content-Length", "Transfer-Encoding", "Content-Encoding":
+			continue // describe the 304 itself, not the stored body
+		}
+		h[k] = v
+	}
+	_, newETag := notModified["Etag"]
+	return response{
+		Body:          stale.Body,
+		Status:        stale.Status,
+		Header:        h,
+		GeneratedETag: stale.GeneratedETag && !newETag,
+	}
+}
+
+// staleResponse marks a copy of the response as stale.
+func staleResponse(resp response, warning string) response {
+	h := resp.Header.Clone()
+	h.Add("Warning", warning)
+	return response{
+		Body:          resp.Body,
+		Status:        resp.Status,
+		Header:        h,
+		Stale:         true,
+		Fetched:       resp.Fetched,
+		GeneratedETag: resp.GeneratedETag,
+	}
+}
+
+// loadEntry is the groupcache getter logic: it fetches the key from the
+// backend, revalidating a retained stale response when available, and
+// returns the encoded response along with its expiration.
+//
+// Within the stale-while-revalidate window, the stale response is returned
+// immediately while a background refresh updates the stale store. Since the
+// getter only runs on the key owner, refreshes are de-duplicated across the
+// cluster.
+func (app *application) loadEntry(ctx context.Context, key string) ([]byte, time.Time, error) {
+
+	const me = "app.loadEntry"
+
+	stale, foundStale := app.stale.get(key)
+
+	resp, expire, errFetch := app.staleOrFetch(ctx, key, stale, foundStale)
+	if errFetch != nil {
+		return nil, time.Time{}, errFetch
+	}
+	resp.Expire = expire
+
+	data, errEncode := app.encodeResponse(resp)
+	if errEncode != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: encode response: %v", me, errEncode)
+	}
+
+	return data, expire, nil
+}
+
+func (app *application) staleOrFetch(ctx context.Context, key string,
+	stale staleEntry, foundStale bool) (response, time.Time, error) {
+
+	if foundStale {
+		now := time.Now()
+
+		if now.Before(stale.expire) {
+			//
+			// still fresh: refreshed in background, or evicted from groupcache
+			//
+			return stale.resp, stale.expire, nil
+		}
+
+		if now.Before(stale.expire.Add(app.cfg.cacheStaleWhileRevalidate)) {
+			app.refreshInBackground(key, stale)
+			//
+			// expiration in the past: groupcache must not keep serving the stale
+			// response, the next lookup should find the refreshed one.
+			//
+			return staleResponse(stale.resp, `110 - "Response is Stale"`), now, nil
+		}
+	}
+
+	return app.fetchEntry(ctx, key, stale, foundStale)
+}
+
+// refreshInBackground refreshes the stale entry, unless a refresh for the key
+// is already running.
+func (app *application) refreshInBackground(key string, stale staleEntry) {
+	if _, running := app.refreshing.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer app.refreshing.Delete(key)
+
+		const me = "app.refreshInBackground"
+		ctx, cancel := context.WithTimeout(app.backgroundCtx, app.cfg.backendTimeout)
+		defer cancel()
+		ctx, span := app.tracer.Start(ctx, me)
+		defer span.End()
+
+		if _, _, err := app.fetchEntry(ctx, key, stale, true); err != nil && !isNotStored(err) {
+			log.Error().Msgf("%s: key='%s': %v", me, redactKey(key), err)
+		}
+	}()
+}
+
+// fetchEntry fetches the key from the backend, revalidating the stale
+// response when available, and retains the result in the stale store.
+func (app *application) fetchEntry(ctx context.Context, key string,
+	stale staleEntry, foundStale bool) (response, time.Time, error) {
+
+	const me = "app.fetchEntry"
+
+	app.fetches.begin()
+	defer app.fetches.end()
+
+	generation := app.stale.generation()
+
+	var conditional http.Header
+	if foundStale {
+		conditional = validators(stale.resp)
+	}
+
+	resp, isErrorStatus, errFetch := doFetch(ctx, app.tracer, app.httpClient,
+		app.backendURL, key, conditional, app.recordBackendFetch)
+
+	if errFetch != nil || resp.Status >= 500 {
+		now := time.Now()
+		maxStale := stale.expire.Add(app.cfg.cacheStaleIfError)
+		if foundStale && now.Before(maxStale) {
+			//
+			// backend failed: serve the last good response, retrying the
+			// backend after CACHE_ERROR_TTL
+			//
+			log.Info().Msgf("%s: key='%s' backend failed, serving stale response: status=%d error=%v",
+				me, redactKey(key), resp.Status, errFetch)
+			expire := now.Add(app.cfg.cacheErrorTTL)
+			if expire.After(maxStale) {
+				expire = maxStale
+			}
+			return staleResponse(stale.resp, `111 - "Revalidation Failed"`), expire, nil
+		}
+	}
+
+	if errFetch != nil {
+		return resp, time.Time{}, errFetch
+	}
+
+	if foundStale && resp.Status == http.StatusNotModified {
+		log.Debug().Msgf("%s: key='%s' revalidated", me, redactKey(key))
+		resp = refreshStale(stale.resp, resp.Header)
+		isErrorStatus = isHTTPError(resp.Status)
+	}
+
+	resp.Fetched = time.Now()
+
+	expire, store := app.entryExpire(key, resp, isErrorStatus)
+
+	if !store {
+		app.stale.remove(key)
+		return resp, time.Time{}, &notStoredError{resp: resp}
+	}
+
+	if !isErrorStatus && app.peers.owns(key) {
+		app.stale.put(key, resp, expire, generation) // each peer retains only its keys
+	}
+
+	return resp, expire, nil
+}
+
+// notStoredError is returned by the getter for responses that must not be
+// stored, like Cache-Control no-store or private, since groupcache has no
+// other way to refuse a loaded value. Errors are never cached by groupcache.
+//
+// Groupcache answers getter errors to peers with 503, which the requesting
+// peer receives as ErrRemoteCall: it neither retries the getter locally nor
+// counts a peer error. Since peers deliver only the error message, the
+// message carries the encoded response, so the requesting peer does not
+// fetch it again from the backend.
+type notStoredError struct {
+	resp response
+}
+
+func (e *notStoredError) Error() string {
+	data := encodeResponseBinary(e.resp)
+	if base64.StdEncoding.EncodedLen(len(data)) > notStoredMaxMessage {
+		return errNotStoredMsg // too large: the requesting peer fetches it
+	}
+	return errNotStoredMsg + ": " + base64.StdEncoding.EncodeToString(data)
+}
+
+// errNotStoredMsg identifies the error when returned by a peer, which
+// delivers only the error message.
+const errNotStoredMsg = "kubecache: response must not be stored"
+
+// notStoredMaxMessage bounds the response carried in the error message,
+// below the 1 MiB that groupcache reads from a peer error.
+const notStoredMaxMessage = 512 * 1024
+
+func isNotStored(err error) bool {
+	_, _, found := notStored(err)
+	return found
+}
+
+// notStored reports whether the getter refused to store the response.
+// The response is available when the getter ran locally, or when the peer
+// that ran it was able to carry it in the error message.
+func notStored(err error) (response, bool, bool) {
+	if err == nil {
+		return response{}, false, false
+	}
+	var errNotStored *notStoredError
+	if errors.As(err, &errNotStored) {
+		return errNotStored.resp, true, true
+	}
+	msg := err.Error()
+	i := strings.Index(msg, errNotStoredMsg)
+	if i < 0 {
+		return response{}, false, false
+	}
+	encoded, found := strings.CutPrefix(msg[i+len(errNotStoredMsg):], ": ")
+	if !found {
+		return response{}, false, true
+	}
+	data, errBase64 := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if errBase64 != nil {
+		return response{}, false, true
+	}
+	resp, errDecode := decodeResponse(data)
+	if errDecode != nil {
+		return response{}, false, true
+	}
+	return resp, true, true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// varyStore remembers, per route, the request headers the backend
+// announced in its Vary response header, so that following requests
+// for the route include those headers in the cache key.
+type varyStore struct {
+	mu        sync.Mutex
+	routes    map[string][]string
+	maxRoutes int
+}
+
+func newVaryStore(maxRoutes int) *varyStore {
+	return &varyStore{
+		routes:    map[string][]string{},
+		maxRoutes: maxRoutes,
+	}
+}
+
+// get returns the headers learned for the route.
+func (v *varyStore) get(route string) []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.routes[route]
+}
+
+// learn records the headers from the backend Vary response header.
+// It returns true if new headers were learned for the route.
+func (v *varyStore) learn(route string, respHeader http.Header) bool {
+	names := varyNames(respHeader)
+	if len(names) == 0 {
+		return false
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	known, found := v.routes[route]
+	if !found && len(v.routes) >= v.maxRoutes {
+		log.Error().Msgf("vary store full: maxRoutes=%d: not learning route='%s' vary=%v",
+			v.maxRoutes, route, names)
+		return false
+	}
+
+	merged := slices.Clone(known)
+	for _, n := range names {
+		if n == "*" {
+			continue // no key can represent Vary: *
+		}
+		if !slices.Contains(merged, n) {
+			merged = append(merged, n)
+		}
+	}
+	if len(merged) == len(known) {
+		return false
+	}
+	slices.Sort(merged)
+	v.routes[route] = merged
+	return true
+}
+
+// varyNames returns the canonical header names found in the Vary header.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// varyCovered reports whether every header named in the response Vary
+// header is part of the key header set. Only then is it safe to store
+// the response under the key. Denied headers are covered, since they are
+// never sent to the backend.
+func varyCovered(keyHeader, respHeader http.Header, deny []string) bool {
+	for _, name := range varyNames(respHeader) {
+		if name == "*" {
+			return false
+		}
+		if slices.Contains(deny, name) {
+			continue
+		}
+		if _, found := keyHeader[name]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// keyHeaders collects the request headers that must be part of the cache key:
+// the headers from CACHE_KEY_HEADERS plus those learned from backend Vary.
+// Headers absent from the request are recorded with an empty value, so that
+// a client omitting a header does not share an entry with one sending it.
+// Headers in FORWARD_HEADERS_DENY are never part of the key, since they are
+// never sent to the backend.
+func (app *application) keyHeaders(r *http.Request, route string) http.Header {
+	h := http.Header{}
+	add := func(name string) {
+		if slices.Contains(app.forwardDeny, name) {
+			return
+		}
+		h[name] = []string{strings.Join(r.Header.Values(name), ", ")}
+	}
+	for _, name := range app.cacheKeyHeaders {
+		add(name)
+	}
+	for _, name := range app.vary.get(route) {
+		add(name)
+	}
+	return h
+}
@@ -10,6 +10,7 @@ require (
 	github.com/modernprogram/groupcache/v2 v2.7.7
 	github.com/prometheus/client_golang v1.22.0
 	github.com/rs/zerolog v1.34.0
+	github.com/udhos/aws-emf v0.0.5
 	github.com/udhos/boilerplate v1.6.10
 	github.com/udhos/dogstatsdclient v0.1.0
 	github.com/udhos/ecs-task-discovery v1.1.1
@@ -107,7 +108,6 @@ require (
 	github.com/ryanuber/go-glob v1.0.0 // indirect
 	github.com/segmentio/fasthash v1.0.3 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
-	github.com/udhos/aws-emf v0.0.5 // indirect
 	github.com/udhos/cloudwatchlog v0.0.3 // indirect
 	github.com/udhos/kubepodinformer v1.0.5 // indirect
 	github.com/x448/float16 v0.8.4 // indirect